@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/30x/keymaster/nginx"
+)
+
+//Controller what the admin API inspects and controls.  Implemented by nginx.Manager
+type Controller interface {
+	Status() nginx.ManagerStatus
+	RequestPoll()
+	Rollback() error
+	Pause()
+	Resume()
+}
+
+//Server the admin HTTP API.
+//GET /status returns the status of the controller.  POST /poll, /rollback, /pause and /resume control it, returning the status afterwards.
+//With a token set every request must carry it as a bearer token
+type Server struct {
+	controller Controller
+	mux        *http.ServeMux
+	token      string
+}
+
+//errorResponse the body returned when a request fails
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+//NewServer create the admin API for the controller
+func NewServer(controller Controller) *Server {
+	server := &Server{
+		controller: controller,
+		mux:        http.NewServeMux(),
+	}
+
+	server.mux.HandleFunc("/status", server.handleStatus)
+	server.mux.HandleFunc("/poll", server.handleAction(func() error {
+		controller.RequestPoll()
+		return nil
+	}))
+	server.mux.HandleFunc("/rollback", server.handleAction(controller.Rollback))
+	server.mux.HandleFunc("/pause", server.handleAction(func() error {
+		controller.Pause()
+		return nil
+	}))
+	server.mux.HandleFunc("/resume", server.handleAction(func() error {
+		controller.Resume()
+		return nil
+	}))
+
+	return server
+}
+
+//SetToken require every request to have an "Authorization: Bearer <token>" header.  Required to serve on anything but a loopback address
+func (server *Server) SetToken(token string) {
+	server.token = token
+}
+
+//Handle serve another handler from the admin API
+func (server *Server) Handle(pattern string, handler http.Handler) {
+	server.mux.Handle(pattern, handler)
+}
+
+//ListenAndServe serve the admin API on the address.  Blocks until the server fails.
+//Anyone who can reach it can control nginx, so only a loopback address is served without a token
+func (server *Server) ListenAndServe(address string) error {
+	if server.token == "" && !isLoopback(address) {
+		return fmt.Errorf("Refusing to serve the admin API on %s without a token.  Set one, or use a loopback address", address)
+	}
+
+	log.Printf("Serving the admin API on %s", address)
+
+	return http.ListenAndServe(address, server)
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, &errorResponse{Error: "A valid bearer token is required"})
+		return
+	}
+
+	server.mux.ServeHTTP(w, r)
+}
+
+//authorized true if no token is set, or the request has it
+func (server *Server) authorized(r *http.Request) bool {
+	if server.token == "" {
+		return true
+	}
+
+	const prefix = "Bearer "
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(server.token)) == 1
+}
+
+//isLoopback true if the address only listens on a loopback interface
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "Use GET"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, server.controller.Status())
+}
+
+//handleAction run the action on POST, and return the status once it's done
+func (server *Server) handleAction(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: "Use POST"})
+			return
+		}
+
+		err := action()
+		if err != nil {
+			writeJSON(w, http.StatusConflict, &errorResponse{Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, server.controller.Status())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("Unable to write the admin response.  Error is %s", err)
+	}
+}
@@ -0,0 +1,163 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/30x/keymaster/admin"
+	"github.com/30x/keymaster/nginx"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+
+	var controller *controllerTester
+	var server *admin.Server
+
+	BeforeEach(func() {
+		controller = &controllerTester{
+			status: nginx.ManagerStatus{
+				DeploymentID: "deployment_id",
+				ETag:         "deployment_id-1",
+				StagedDir:    "/tmp/deployment_id",
+				NginxRunning: true,
+			},
+		}
+
+		server = admin.NewServer(controller)
+	})
+
+	//requestWithToken make the request against the server with the bearer token, if any, and decode the response
+	requestWithToken := func(method, url, token string, body interface{}) int {
+		req, err := http.NewRequest(method, url, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		Expect(recorder.Header().Get("Content-Type")).Should(Equal("application/json"))
+		Expect(json.Unmarshal(recorder.Body.Bytes(), body)).To(Succeed())
+
+		return recorder.Code
+	}
+
+	//request make the request against the server and decode the response
+	request := func(method, url string, body interface{}) int {
+		return requestWithToken(method, url, "", body)
+	}
+
+	It("should return the status", func() {
+		status := nginx.ManagerStatus{}
+
+		Expect(request("GET", "/status", &status)).Should(Equal(http.StatusOK))
+		Expect(status.DeploymentID).Should(Equal("deployment_id"))
+		Expect(status.ETag).Should(Equal("deployment_id-1"))
+		Expect(status.StagedDir).Should(Equal("/tmp/deployment_id"))
+		Expect(status.NginxRunning).Should(BeTrue())
+	})
+
+	It("should pause, resume and poll", func() {
+		status := nginx.ManagerStatus{}
+
+		Expect(request("POST", "/pause", &status)).Should(Equal(http.StatusOK))
+		Expect(status.Paused).Should(BeTrue())
+
+		Expect(request("POST", "/resume", &status)).Should(Equal(http.StatusOK))
+		Expect(status.Paused).Should(BeFalse())
+
+		Expect(request("POST", "/poll", &status)).Should(Equal(http.StatusOK))
+		Expect(controller.pollRequests).Should(Equal(1))
+	})
+
+	It("should roll back", func() {
+		status := nginx.ManagerStatus{}
+
+		Expect(request("POST", "/rollback", &status)).Should(Equal(http.StatusOK))
+		Expect(controller.rollbacks).Should(Equal(1))
+	})
+
+	It("should return rollback errors", func() {
+		controller.rollbackErr = errors.New("There is no previous deployment to roll back to")
+
+		response := make(map[string]string)
+
+		Expect(request("POST", "/rollback", &response)).Should(Equal(http.StatusConflict))
+		Expect(response["error"]).Should(Equal("There is no previous deployment to roll back to"))
+	})
+
+	It("should only accept POST for actions", func() {
+		response := make(map[string]string)
+
+		for _, url := range []string{"/poll", "/rollback", "/pause", "/resume"} {
+			Expect(request("GET", url, &response)).Should(Equal(http.StatusMethodNotAllowed))
+		}
+
+		Expect(controller.status.Paused).Should(BeFalse())
+		Expect(controller.pollRequests).Should(Equal(0))
+		Expect(controller.rollbacks).Should(Equal(0))
+	})
+
+	It("should require the token once one is set", func() {
+		server.SetToken("s3cret")
+
+		response := make(map[string]string)
+
+		Expect(request("GET", "/status", &response)).Should(Equal(http.StatusUnauthorized))
+		Expect(requestWithToken("POST", "/pause", "wrong", &response)).Should(Equal(http.StatusUnauthorized))
+		Expect(controller.status.Paused).Should(BeFalse())
+
+		status := nginx.ManagerStatus{}
+
+		Expect(requestWithToken("POST", "/pause", "s3cret", &status)).Should(Equal(http.StatusOK))
+		Expect(status.Paused).Should(BeTrue())
+	})
+
+	It("should refuse to serve on a non loopback address without a token", func() {
+		err := server.ListenAndServe("0.0.0.0:0")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("without a token"))
+
+		err = server.ListenAndServe(":0")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+//mock controller
+type controllerTester struct {
+	status       nginx.ManagerStatus
+	pollRequests int
+	rollbacks    int
+	rollbackErr  error
+}
+
+func (controller *controllerTester) Status() nginx.ManagerStatus {
+	return controller.status
+}
+
+func (controller *controllerTester) RequestPoll() {
+	controller.pollRequests++
+}
+
+func (controller *controllerTester) Rollback() error {
+	if controller.rollbackErr != nil {
+		return controller.rollbackErr
+	}
+
+	controller.rollbacks++
+	return nil
+}
+
+func (controller *controllerTester) Pause() {
+	controller.status.Paused = true
+}
+
+func (controller *controllerTester) Resume() {
+	controller.status.Paused = false
+}
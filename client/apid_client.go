@@ -2,17 +2,23 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/30x/keymaster/metrics"
 )
 
 //ApidClient the apidClient
 type ApidClient interface {
-	//PollDeployments poll the deployments and return the deployment
-	PollDeployments(etag string, timeout int) (*Deployment, error)
+	//PollDeployments poll the deployments and return the deployment.  The poll is abandoned if ctx is cancelled
+	PollDeployments(ctx context.Context, etag string, timeout int) (*Deployment, error)
 
 	//SetDeploymentResult set the deployment result
 	SetDeploymentResult(result *DeploymentResult) error
@@ -24,11 +30,65 @@ type ApidClientImpl struct {
 	client       *http.Client
 }
 
+//Error codes reported to apid in DeploymentError and BundleError, so failures can be classified.  The values are part of the apid contract, never reuse or renumber them
 const (
-	//ErrorCodeTODO the placeholder for errors
-	ErrorCodeTODO = 1
+	//ErrorCodeInternal keymaster failed for a reason unrelated to the deployment, e.g. it couldn't create a temp dir
+	ErrorCodeInternal = 1
+	//ErrorCodeDownloadFailed a bundle could not be fetched from its url
+	ErrorCodeDownloadFailed = 2
+	//ErrorCodeVerificationFailed a bundle did not match its checksum or signature
+	ErrorCodeVerificationFailed = 3
+	//ErrorCodeUnzipFailed a bundle is not a valid zip, or is outside the unzip limits
+	ErrorCodeUnzipFailed = 4
+	//ErrorCodeBundleInvalid a bundle's bundle.yaml is missing or invalid
+	ErrorCodeBundleInvalid = 5
+	//ErrorCodePipeMissing a pipe in bundle.yaml has no pipe file, or a pipe file is not in bundle.yaml
+	ErrorCodePipeMissing = 6
+	//ErrorCodeDeploymentInvalid the deployment gives a bundle an invalid target or virtual host
+	ErrorCodeDeploymentInvalid = 7
+	//ErrorCodeConflict bundles serve the same path on the same virtual host
+	ErrorCodeConflict = 8
+	//ErrorCodeTemplateError the system bundle's templates could not be rendered
+	ErrorCodeTemplateError = 9
+	//ErrorCodeNginxConfigInvalid nginx rejected the rendered config, or reported warnings for it
+	ErrorCodeNginxConfigInvalid = 10
+	//ErrorCodeNginxStartFailed nginx was not running and could not be started with the new config
+	ErrorCodeNginxStartFailed = 11
+	//ErrorCodeNginxReloadFailed nginx could not be reloaded with the new config
+	ErrorCodeNginxReloadFailed = 12
+	//ErrorCodeTimeout nginx did not finish starting in time
+	ErrorCodeTimeout = 13
+	//ErrorCodeHealthCheckFailed nginx accepted the new config, but the deployment was not live after it was applied
+	ErrorCodeHealthCheckFailed = 14
+)
+
+const (
+	//pollDeadlineGrace the time we allow past the requested block timeout before giving up on a long poll.
+	//apid holds the request open for the full timeout, so we need to allow for the round trip on top of it
+	pollDeadlineGrace = 10 * time.Second
+
+	//resultTimeout the most time we wait for apid to accept a deployment result
+	resultTimeout = 30 * time.Second
 )
 
+//ErrNotModified returned from PollDeployments when apid has no deployment newer than the etag we polled with
+var ErrNotModified = errors.New("Deployment has not been modified")
+
+//StatusError returned from SetDeploymentResult when apid responds with anything but 200
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("Expected response code %d, but response code was %d.  Reason is %s", http.StatusOK, err.StatusCode, err.Status)
+}
+
+//Rejected true if apid rejected the request itself, so sending it again will fail the same way.  Timeouts and rate limiting are worth retrying
+func (err *StatusError) Rejected() bool {
+	return err.StatusCode >= 400 && err.StatusCode < 500 && err.StatusCode != http.StatusRequestTimeout && err.StatusCode != http.StatusTooManyRequests
+}
+
 //Deployment the type of deployment to return
 type Deployment struct {
 	ETAG    string
@@ -41,6 +101,10 @@ type Deployment struct {
 type SystemBundle struct {
 	BundleID string `json:"bundleId"`
 	URL      string `json:"url"`
+	//Checksum the optional hex encoded sha256 of the bundle zip
+	Checksum string `json:"checksum"`
+	//Signature the optional base64 encoded signature of the sha256 of the bundle zip
+	Signature string `json:"signature"`
 }
 
 //FilePath parse the file path in teh bundle
@@ -50,12 +114,16 @@ func (bundle *SystemBundle) FilePath() string {
 
 //DeploymentBundle the bundle to deploy in a response
 type DeploymentBundle struct {
-	BundleID string `json:"bundleId"`
-	AuthCode string `json:"authCode"`
-	URL      string `json:"url"`
-	BasePath string `json:"basePath"`
-	Target   string `json:"target"`
+	BundleID     string   `json:"bundleId"`
+	AuthCode     string   `json:"authCode"`
+	URL          string   `json:"url"`
+	BasePath     string   `json:"basePath"`
+	Target       string   `json:"target"`
 	VirtualHosts []string `json:"virtualHosts"`
+	//Checksum the optional hex encoded sha256 of the bundle zip
+	Checksum string `json:"checksum"`
+	//Signature the optional base64 encoded signature of the sha256 of the bundle zip
+	Signature string `json:"signature"`
 }
 
 //FilePath parse the file path in the bundle
@@ -83,6 +151,8 @@ type DeploymentError struct {
 	ErrorCode    int           `json:"errorCode"`
 	Reason       string        `json:"reason"`
 	BundleErrors []BundleError `json:"bundleErrors"`
+	//RolledBackTo the ID of the deployment nginx was rolled back to after this one failed to apply.  Empty if there was no rollback
+	RolledBackTo string `json:"rolledBackTo,omitempty"`
 }
 
 //BundleError Any Bundle-specific error that occurred on deployment
@@ -105,16 +175,18 @@ const (
 //CreateApidClient create the client and validate the input
 func CreateApidClient(apidHostPath string) (ApidClient, error) {
 
-	//return the apid client
+	//return the apid client.  There's no client timeout, long polls are held open for as long as we ask, so each request sets its own deadline
 	return &ApidClientImpl{
 		apidHostPath: apidHostPath,
 		client:       &http.Client{},
 	}, nil
 }
 
-//PollDeployments poll the deployments fromthe apidHostPath with the etag (optional) and timeout (0 for none)
-//returns the deployment response, or an error if one occurs.  A nil deploymentresponse indicates a timeout on polling (TODO, should this be a custom error?)
-func (apidClient *ApidClientImpl) PollDeployments(etag string, timeout int) (*Deployment, error) {
+//PollDeployments poll the deployments fromthe apidHostPath with the etag (optional) and timeout in seconds (0 for none)
+//When a timeout is specified, apid will hold the request open until a deployment with a different etag is available, or the timeout elapses.
+//returns the deployment response, or an error if one occurs.  ErrNotModified is returned if the timeout elapsed without a new deployment.
+//Cancelling ctx abandons the poll
+func (apidClient *ApidClientImpl) PollDeployments(ctx context.Context, etag string, timeout int) (*Deployment, error) {
 
 	url := apidClient.apidHostPath + "/deployments/current"
 	req, err := http.NewRequest("GET", url, nil)
@@ -127,26 +199,37 @@ func (apidClient *ApidClientImpl) PollDeployments(etag string, timeout int) (*De
 		req.Header.Add("If-None-Match", etag)
 	}
 
-	//TODO not ready yet, uncomment when long poll is implemented
-	// if timeout > 0 {
-	// 	req.Header.Add("block", string(timeout))
-	// }
+	if timeout > 0 {
+		req.Header.Add("block", strconv.Itoa(timeout))
+
+		//don't wait forever on apid.  Give up once it should have responded to the block
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second+pollDeadlineGrace)
+		defer cancel()
+	}
+
+	req = req.WithContext(ctx)
 
 	req.Header.Add("Accept", "application/json")
 
+	pollStart := time.Now()
 	resp, err := apidClient.client.Do(req)
+	metrics.PollDuration.Observe(metrics.Since(pollStart))
 
 	if err != nil {
+		metrics.Polls.WithLabelValues("error").Inc()
 		return nil, err
 	}
 
-	//we timed out, return nothing.  TODO make this a better error type
-	if resp.StatusCode == http.StatusNotModified {
-		return nil, nil
-	}
+	metrics.Polls.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
 
 	defer resp.Body.Close()
 
+	//we timed out, nothing has changed
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, ErrNotModified
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		errorBody, err := ioutil.ReadAll(resp.Body)
 
@@ -185,6 +268,15 @@ func (apidClient *ApidClientImpl) SetDeploymentResult(result *DeploymentResult)
 
 	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
 
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resultTimeout)
+	defer cancel()
+
+	req = req.WithContext(ctx)
+
 	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := apidClient.client.Do(req)
@@ -193,13 +285,13 @@ func (apidClient *ApidClientImpl) SetDeploymentResult(result *DeploymentResult)
 		return err
 	}
 
+	//no need to read the body
+	defer resp.Body.Close()
+
 	//if it wasn't successful, throw an error
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Expected response code %d, but response code was %d.  Reason is %s", http.StatusOK, resp.StatusCode, resp.Status)
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	//no need to read the body
-	resp.Body.Close()
-
 	return nil
 }
@@ -1,12 +1,14 @@
 package client_test
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/30x/keymaster/client"
 	"github.com/30x/keymaster/test"
@@ -43,6 +45,28 @@ var _ = Describe("Bundle Tests", func() {
 		Expect(err).Should(BeNil())
 	})
 
+	It("Rejected Result", func() {
+
+		deploymentID := "deploymentFoo"
+
+		mockApiServer := test.CreateMockApidServer()
+		mockApiServer.MockDeployment(deploymentID, http.StatusBadRequest, []byte("invalid result"))
+
+		mockApiServer.Start()
+		defer mockApiServer.Stop()
+
+		apiClient, err := client.CreateApidClient("http://localhost:9000")
+
+		Expect(err).Should(BeNil())
+
+		err = apiClient.SetDeploymentResult(&client.DeploymentResult{ID: deploymentID, Status: client.StatusSuccess})
+
+		statusErr, ok := err.(*client.StatusError)
+		Expect(ok).Should(BeTrue())
+		Expect(statusErr.StatusCode).Should(Equal(http.StatusBadRequest))
+		Expect(statusErr.Rejected()).Should(BeTrue())
+	})
+
 	It("Parse Deployments", func() {
 
 		//start the mock api server
@@ -63,7 +87,7 @@ var _ = Describe("Bundle Tests", func() {
 
 		Expect(err).Should(BeNil())
 
-		deployment, err := client.PollDeployments("", 60)
+		deployment, err := client.PollDeployments(context.Background(), "", 60)
 
 		Expect(err).Should(BeNil())
 
@@ -101,6 +125,119 @@ var _ = Describe("Bundle Tests", func() {
 
 	})
 
+	It("Long Poll Not Modified", func() {
+
+		mockApiServer := createBundles("deployment1", []string{"1"}, 0)
+		mockApiServer.Start()
+		defer mockApiServer.Stop()
+
+		apiClient, err := client.CreateApidClient("http://localhost:9000")
+
+		Expect(err).Should(BeNil())
+
+		//no etag, we should get the deployment immediately
+		deployment, err := apiClient.PollDeployments(context.Background(), "", 1)
+
+		Expect(err).Should(BeNil())
+		Expect(deployment.ID).Should(Equal("deployment1"))
+		Expect(deployment.ETAG).ShouldNot(BeEmpty())
+
+		//same etag, apid should hold us for the block timeout
+		start := time.Now()
+
+		deployment, err = apiClient.PollDeployments(context.Background(), deployment.ETAG, 1)
+
+		Expect(err).Should(Equal(client.ErrNotModified))
+		Expect(deployment).Should(BeNil())
+		Expect(time.Since(start)).Should(BeNumerically(">=", time.Second))
+	})
+
+	It("Not Modified Without Blocking", func() {
+
+		mockApiServer := createBundles("deployment1", []string{"1"}, 0)
+		mockApiServer.Start()
+		defer mockApiServer.Stop()
+
+		apiClient, err := client.CreateApidClient("http://localhost:9000")
+
+		Expect(err).Should(BeNil())
+
+		deployment, err := apiClient.PollDeployments(context.Background(), "", 0)
+
+		Expect(err).Should(BeNil())
+
+		//no block, apid should tell us immediately nothing has changed
+		deployment, err = apiClient.PollDeployments(context.Background(), deployment.ETAG, 0)
+
+		Expect(err).Should(Equal(client.ErrNotModified))
+		Expect(deployment).Should(BeNil())
+	})
+
+	It("Long Poll New Deployment", func() {
+
+		mockApiServer := createBundles("deployment1", []string{"1"}, 0)
+		mockApiServer.Start()
+		defer mockApiServer.Stop()
+
+		apiClient, err := client.CreateApidClient("http://localhost:9000")
+
+		Expect(err).Should(BeNil())
+
+		deployment, err := apiClient.PollDeployments(context.Background(), "", 30)
+
+		Expect(err).Should(BeNil())
+		Expect(deployment.ID).Should(Equal("deployment1"))
+
+		//publish a new deployment while we're blocked
+		go func() {
+			defer GinkgoRecover()
+
+			time.Sleep(200 * time.Millisecond)
+
+			err := mockApiServer.CreateGetBundles(http.StatusOK, "deployment2", test.SystemBundle{BundleID: "system-revision-1"}, nil, 0)
+			Expect(err).Should(BeNil())
+		}()
+
+		start := time.Now()
+
+		newDeployment, err := apiClient.PollDeployments(context.Background(), deployment.ETAG, 30)
+
+		Expect(err).Should(BeNil())
+		Expect(newDeployment.ID).Should(Equal("deployment2"))
+		Expect(newDeployment.ETAG).ShouldNot(Equal(deployment.ETAG))
+
+		//we should return as soon as the deployment changes, not at the block timeout
+		Expect(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+	})
+
+	It("Cancelled Long Poll", func() {
+
+		mockApiServer := createBundles("deployment1", []string{"1"}, 0)
+		mockApiServer.Start()
+		defer mockApiServer.Stop()
+
+		apiClient, err := client.CreateApidClient("http://localhost:9000")
+
+		Expect(err).Should(BeNil())
+
+		deployment, err := apiClient.PollDeployments(context.Background(), "", 0)
+
+		Expect(err).Should(BeNil())
+
+		//cancel while apid is holding the poll open
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+
+		start := time.Now()
+
+		deployment, err = apiClient.PollDeployments(ctx, deployment.ETAG, 30)
+
+		Expect(err).ShouldNot(BeNil())
+		Expect(err).ShouldNot(Equal(client.ErrNotModified))
+		Expect(deployment).Should(BeNil())
+		Expect(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+	})
+
 })
 
 func createBundles(deploymentId string, bundIds []string, timeout int) *test.MockApidServer {
@@ -155,7 +292,7 @@ func copyBundleFile(destFileUrl string) {
 
 	Expect(err).Should(BeNil())
 
-	_, err = io.Copy(src, target)
+	_, err = io.Copy(target, src)
 
 	Expect(err).Should(BeNil())
 	src.Close()
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/30x/keymaster/util"
+)
+
+//outboxSuffix the suffix of queued result files
+const outboxSuffix = ".json"
+
+//OutboxClient an ApidClient that queues deployment results in a directory and delivers them to apid in the background.
+//Delivery is retried with backoff until apid accepts each result, and results queued before a restart are delivered after it.
+//Results are delivered in the order they were queued.  A newer result for a deployment replaces any that hasn't been delivered yet.
+//A result apid rejects with a 4xx is dropped, sending it again would only be rejected again
+type OutboxClient struct {
+	apiClient ApidClient
+	dir       string
+	backoff   *util.Backoff
+
+	//mutex guards the files in the outbox
+	mutex sync.Mutex
+	//flushMutex serializes delivery, so a result is never delivered twice at once
+	flushMutex sync.Mutex
+	//wake signals Run there's something new to deliver
+	wake chan struct{}
+}
+
+//NewOutboxClient queue the results for apiClient in dir, which is created if it doesn't exist.  Polls go straight to apiClient
+func NewOutboxClient(apiClient ApidClient, dir string, backoff *util.Backoff) (*OutboxClient, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutboxClient{
+		apiClient: apiClient,
+		dir:       dir,
+		backoff:   backoff,
+		wake:      make(chan struct{}, 1),
+	}, nil
+}
+
+//PollDeployments poll apid directly
+func (outbox *OutboxClient) PollDeployments(ctx context.Context, etag string, timeout int) (*Deployment, error) {
+	return outbox.apiClient.PollDeployments(ctx, etag, timeout)
+}
+
+//SetDeploymentResult queue the result for delivery.  Only returns an error if it couldn't be queued
+func (outbox *OutboxClient) SetDeploymentResult(result *DeploymentResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	//apid only cares about the latest result for a deployment
+	superseded, err := outbox.pending()
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(outbox.dir, ".queue")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	//name the file so it sorts in the order it was queued
+	fileName := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), outboxFileName(result.ID), outboxSuffix)
+
+	err = os.Rename(tmpFile.Name(), filepath.Join(outbox.dir, fileName))
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	for _, file := range superseded {
+		if file != fileName && outboxDeploymentFile(file) == outboxFileName(result.ID) {
+			os.Remove(filepath.Join(outbox.dir, file))
+		}
+	}
+
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+//Pending the number of results that haven't been delivered
+func (outbox *OutboxClient) Pending() (int, error) {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	files, err := outbox.pending()
+
+	return len(files), err
+}
+
+//Flush try to deliver every queued result once, in order.  Stops at the first result apid can't accept right now, and returns its error
+func (outbox *OutboxClient) Flush() error {
+	outbox.flushMutex.Lock()
+	defer outbox.flushMutex.Unlock()
+
+	outbox.mutex.Lock()
+	files, err := outbox.pending()
+	outbox.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		filePath := filepath.Join(outbox.dir, file)
+
+		data, err := ioutil.ReadFile(filePath)
+
+		//superseded while we were delivering
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		result := &DeploymentResult{}
+
+		//we can never deliver a corrupt result, drop it rather than blocking the rest
+		err = json.Unmarshal(data, result)
+		if err != nil {
+			log.Printf("Dropping unreadable deployment result %s.  Error is %s", filePath, err)
+			os.Remove(filePath)
+			continue
+		}
+
+		err = outbox.apiClient.SetDeploymentResult(result)
+
+		//apid will never accept it, drop it rather than blocking the rest
+		if statusErr, ok := err.(*StatusError); ok && statusErr.Rejected() {
+			log.Printf("Dropping the result of deployment %s, apid rejected it.  Error is %s", result.ID, err)
+		} else if err != nil {
+			return fmt.Errorf("Unable to deliver the result of deployment %s.  %s", result.ID, err)
+		}
+
+		outbox.mutex.Lock()
+		err = os.Remove(filePath)
+		outbox.mutex.Unlock()
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Run deliver queued results until ctx is cancelled, backing off while apid isn't accepting them
+func (outbox *OutboxClient) Run(ctx context.Context) {
+	for {
+		delay := time.Duration(-1)
+
+		err := outbox.Flush()
+
+		if err != nil {
+			delay = outbox.backoff.Next()
+			log.Printf("%s.  Retrying in %s", err, delay)
+		} else {
+			outbox.backoff.Reset()
+		}
+
+		var retry <-chan time.Time
+
+		if delay >= 0 {
+			retry = time.After(delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-outbox.wake:
+		case <-retry:
+		}
+	}
+}
+
+//pending the queued result files, oldest first
+func (outbox *OutboxClient) pending() ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(outbox.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() && !strings.HasPrefix(fileInfo.Name(), ".") && strings.HasSuffix(fileInfo.Name(), outboxSuffix) {
+			files = append(files, fileInfo.Name())
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+//outboxDeploymentFile the deployment part of a queued result's file name
+func outboxDeploymentFile(file string) string {
+	name := strings.TrimSuffix(file, outboxSuffix)
+
+	index := strings.Index(name, "-")
+	if index < 0 {
+		return ""
+	}
+
+	return name[index+1:]
+}
+
+//outboxFileName a file name safe version of the deployment ID.  Escaped rather than replaced, so different IDs never share a file name
+func outboxFileName(deploymentID string) string {
+	return url.PathEscape(deploymentID)
+}
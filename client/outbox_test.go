@@ -0,0 +1,203 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Outbox", func() {
+
+	var outboxDir string
+	var apid *resultRecorder
+
+	BeforeEach(func() {
+		var err error
+		outboxDir, err = util.MkTempDir("", "outbox", 0755)
+		Expect(err).NotTo(HaveOccurred())
+
+		apid = &resultRecorder{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(outboxDir)
+	})
+
+	newOutbox := func() *client.OutboxClient {
+		outbox, err := client.NewOutboxClient(apid, outboxDir, util.NewBackoff(10*time.Millisecond, 50*time.Millisecond))
+		Expect(err).NotTo(HaveOccurred())
+		return outbox
+	}
+
+	It("should queue results until apid accepts them", func() {
+		outbox := newOutbox()
+		apid.setErr(errors.New("apid is down"))
+
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment1", Status: client.StatusSuccess})).To(Succeed())
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment2", Status: client.StatusFail})).To(Succeed())
+
+		Expect(outbox.Flush()).ShouldNot(Succeed())
+		Expect(outbox.Pending()).Should(Equal(2))
+
+		apid.setErr(nil)
+
+		Expect(outbox.Flush()).To(Succeed())
+		Expect(outbox.Pending()).Should(Equal(0))
+
+		//delivered in the order they were queued
+		Expect(apid.delivered()).Should(Equal([]string{"deployment1", "deployment2"}))
+	})
+
+	It("should replace undelivered results for the same deployment", func() {
+		outbox := newOutbox()
+		apid.setErr(errors.New("apid is down"))
+
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment1", Status: client.StatusFail})).To(Succeed())
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment1", Status: client.StatusSuccess})).To(Succeed())
+
+		Expect(outbox.Pending()).Should(Equal(1))
+
+		apid.setErr(nil)
+
+		Expect(outbox.Flush()).To(Succeed())
+		Expect(apid.results).Should(HaveLen(1))
+		Expect(apid.results[0].Status).Should(Equal(client.StatusSuccess))
+	})
+
+	It("should deliver results queued before a restart", func() {
+		apid.setErr(errors.New("apid is down"))
+
+		Expect(newOutbox().SetDeploymentResult(&client.DeploymentResult{ID: "deployment1", Status: client.StatusSuccess})).To(Succeed())
+
+		apid.setErr(nil)
+
+		//a new outbox on the same dir, as after a restart
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		outbox := newOutbox()
+		go outbox.Run(ctx)
+
+		Eventually(apid.delivered).Should(Equal([]string{"deployment1"}))
+		Eventually(outbox.Pending).Should(Equal(0))
+	})
+
+	It("should keep results for deployment IDs that only differ by a separator", func() {
+		outbox := newOutbox()
+		apid.setErr(errors.New("apid is down"))
+
+		for _, id := range []string{"org/env", "org\\env", "org_env", "org%2Fenv"} {
+			Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: id, Status: client.StatusSuccess})).To(Succeed())
+		}
+
+		Expect(outbox.Pending()).Should(Equal(4))
+
+		apid.setErr(nil)
+
+		Expect(outbox.Flush()).To(Succeed())
+		Expect(apid.delivered()).Should(Equal([]string{"org/env", "org\\env", "org_env", "org%2Fenv"}))
+	})
+
+	It("should drop results apid rejects", func() {
+		outbox := newOutbox()
+		apid.setErr(&client.StatusError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"})
+
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment1", Status: client.StatusSuccess})).To(Succeed())
+
+		Expect(outbox.Flush()).To(Succeed())
+		Expect(outbox.Pending()).Should(Equal(0))
+
+		//the next result isn't held up behind it
+		apid.setErr(nil)
+
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment2", Status: client.StatusSuccess})).To(Succeed())
+		Expect(outbox.Flush()).To(Succeed())
+		Expect(apid.delivered()).Should(Equal([]string{"deployment2"}))
+	})
+
+	It("should keep results apid fails to accept", func() {
+		outbox := newOutbox()
+
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment1", Status: client.StatusSuccess})).To(Succeed())
+
+		for _, statusCode := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusRequestTimeout} {
+			apid.setErr(&client.StatusError{StatusCode: statusCode, Status: http.StatusText(statusCode)})
+
+			Expect(outbox.Flush()).ShouldNot(Succeed())
+			Expect(outbox.Pending()).Should(Equal(1))
+		}
+
+		apid.setErr(nil)
+
+		Expect(outbox.Flush()).To(Succeed())
+		Expect(apid.delivered()).Should(Equal([]string{"deployment1"}))
+	})
+
+	It("should retry in the background until apid accepts", func() {
+		outbox := newOutbox()
+		apid.setErr(errors.New("apid is down"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go outbox.Run(ctx)
+
+		Expect(outbox.SetDeploymentResult(&client.DeploymentResult{ID: "deployment1", Status: client.StatusSuccess})).To(Succeed())
+
+		Consistently(apid.delivered, 100*time.Millisecond).Should(BeEmpty())
+
+		apid.setErr(nil)
+
+		Eventually(apid.delivered).Should(Equal([]string{"deployment1"}))
+	})
+})
+
+//resultRecorder an apid client that records the results it accepts
+type resultRecorder struct {
+	mutex   sync.Mutex
+	err     error
+	results []*client.DeploymentResult
+}
+
+func (recorder *resultRecorder) setErr(err error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.err = err
+}
+
+func (recorder *resultRecorder) delivered() []string {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	ids := []string{}
+	for _, result := range recorder.results {
+		ids = append(ids, result.ID)
+	}
+
+	return ids
+}
+
+func (recorder *resultRecorder) PollDeployments(ctx context.Context, etag string, timeout int) (*client.Deployment, error) {
+	return nil, client.ErrNotModified
+}
+
+func (recorder *resultRecorder) SetDeploymentResult(result *client.DeploymentResult) error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if recorder.err != nil {
+		return recorder.err
+	}
+
+	recorder.results = append(recorder.results, result)
+	return nil
+}
@@ -1,26 +1,88 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
 	"time"
 
 	"log"
 
+	"github.com/30x/keymaster/admin"
 	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/metrics"
 	"github.com/30x/keymaster/nginx"
+	"github.com/30x/keymaster/util"
 	"github.com/spf13/viper"
 )
 
 const (
 	//ConfigApidURI defualt config value for the apid location
 	ConfigApidURI = "apid_uri"
-	//ConfigPollWait the number of seconds to wait after successfully polling apid before polling again
+	//ConfigPollWait the number of seconds apid should hold a poll open waiting for a new deployment
 	ConfigPollWait = "apid_poll_wait"
 
+	//ConfigBackoffInitial the number of seconds to wait before polling again after the first error
+	ConfigBackoffInitial = "backoff_initial"
+	//ConfigBackoffMax the most seconds to wait before polling again after consecutive errors
+	ConfigBackoffMax = "backoff_max"
+	//ConfigBackoffJitter the fraction of the wait after an error that's randomized.  0 to 1
+	ConfigBackoffJitter = "backoff_jitter"
+
 	//ConfigNginxDir the directory that nginx is located in
 	ConfigNginxDir = "nginx_dir"
 
 	//ConfigNginxDir the directory that nginx is located in
 	ConfigNginxPid = "nginx_pid_file"
+
+	//ConfigNginxBinary the nginx executable.  Defaults to sbin/nginx in the nginx dir if it's there, otherwise nginx on the PATH
+	ConfigNginxBinary = "nginx_binary"
+	//ConfigNginxGlobals extra global directives passed to every nginx command with -g, e.g. "worker_processes 2;"
+	ConfigNginxGlobals = "nginx_globals"
+	//ConfigNginxEnv extra KEY=VALUE environment variables for nginx, separated by spaces
+	ConfigNginxEnv = "nginx_env"
+
+	//ConfigBundleCacheDir the directory bundles served over http(s) are downloaded to
+	ConfigBundleCacheDir = "bundle_cache_dir"
+
+	//ConfigBundleCacheMaxBytes the size the bundle cache may grow to before the least recently used bundles are evicted
+	ConfigBundleCacheMaxBytes = "bundle_cache_max_bytes"
+
+	//ConfigUnzipMaxBytes the maximum number of bytes a bundle may expand to
+	ConfigUnzipMaxBytes = "unzip_max_bytes"
+	//ConfigUnzipMaxFiles the maximum number of files a bundle may contain
+	ConfigUnzipMaxFiles = "unzip_max_files"
+	//ConfigUnzipMaxCompressionRatio the maximum ratio of a bundle's uncompressed to compressed size
+	ConfigUnzipMaxCompressionRatio = "unzip_max_compression_ratio"
+
+	//ConfigTrustedKeysFile a file of PEM encoded public keys.  If set, every bundle must be signed by one of them
+	ConfigTrustedKeysFile = "trusted_keys_file"
+
+	//ConfigHealthCheckTimeout the number of seconds to wait for a deployment to come up after nginx is reloaded.  0 disables the health check
+	ConfigHealthCheckTimeout = "health_check_timeout"
+	//ConfigHealthCheckStatusURL a url serving the status JSON of the running deployment, whose deploymentId must match once it's live.  Defaults to the status server nginx serves for every deployment.  Required when the health check is enabled
+	ConfigHealthCheckStatusURL = "health_check_status_url"
+
+	//ConfigOutboxDir the directory deployment results are queued in until apid accepts them.  Defaults to outbox in the data dir.  Empty sends them to apid directly, and a result is lost if apid is unavailable
+	ConfigOutboxDir = "outbox_dir"
+
+	//ConfigDataDir the directory keymaster keeps its state in.  If it isn't writable, e.g. we aren't root, keymaster in the temp dir is used instead
+	ConfigDataDir = "data_dir"
+
+	//ConfigStateFile the file the running deployment is persisted to, so it's restored rather than applied again after a restart.  Defaults to state.json in the data dir.  Empty disables it
+	ConfigStateFile = "state_file"
+
+	//ConfigStopNginxOnExit stop nginx when keymaster is shut down, rather than leaving it serving the current deployment
+	ConfigStopNginxOnExit = "stop_nginx_on_exit"
+
+	//ConfigAdminAddress the address to serve the admin API and Prometheus metrics on.  Empty disables it
+	ConfigAdminAddress = "admin_address"
+
+	//ConfigAdminToken the bearer token every admin API request must have.  Required unless the admin address is a loopback address
+	ConfigAdminToken = "admin_token"
 )
 
 func main() {
@@ -30,37 +92,209 @@ func main() {
 	v.AutomaticEnv()
 	v.SetDefault(ConfigApidURI, "http://localhost:8181")
 	v.SetDefault(ConfigPollWait, "5")
+	v.SetDefault(ConfigBackoffInitial, 1)
+	v.SetDefault(ConfigBackoffMax, 300)
+	v.SetDefault(ConfigBackoffJitter, 0.2)
 
 	//use openresty for now.  Must have LUAJIT installed
 	v.SetDefault(ConfigNginxDir, " /usr/local/Cellar/openresty/1.9.15.1/")
 	v.SetDefault(ConfigNginxPid, "/usr/local/var/run/openresty.pid")
+	v.SetDefault(ConfigBundleCacheDir, nginx.DefaultBundleCacheDir)
+	v.SetDefault(ConfigBundleCacheMaxBytes, 1024*1024*1024)
+	v.SetDefault(ConfigUnzipMaxBytes, util.DefaultUnzipLimits.MaxTotalSize)
+	v.SetDefault(ConfigUnzipMaxFiles, util.DefaultUnzipLimits.MaxFiles)
+	v.SetDefault(ConfigUnzipMaxCompressionRatio, util.DefaultUnzipLimits.MaxCompressionRatio)
+	v.SetDefault(ConfigHealthCheckTimeout, int(nginx.DefaultHealthCheckTimeout/time.Second))
+	v.SetDefault(ConfigHealthCheckStatusURL, "http://"+nginx.StatusAddress+"/")
+	v.SetDefault(ConfigAdminAddress, "127.0.0.1:5281")
+	v.SetDefault(ConfigStopNginxOnExit, false)
+	v.SetDefault(ConfigDataDir, "/var/lib/keymaster")
 
 	apidURI := v.GetString(ConfigApidURI)
 	timeout := v.GetInt(ConfigPollWait)
 	nginxDir := v.GetString(ConfigNginxDir)
 	nginxPid := v.GetString(ConfigNginxPid)
+	bundleCacheDir := v.GetString(ConfigBundleCacheDir)
+	bundleCacheMaxBytes := int64(v.GetInt(ConfigBundleCacheMaxBytes))
+	unzipLimits := &util.UnzipLimits{
+		MaxTotalSize:        int64(v.GetInt(ConfigUnzipMaxBytes)),
+		MaxFiles:            v.GetInt(ConfigUnzipMaxFiles),
+		MaxCompressionRatio: v.GetFloat64(ConfigUnzipMaxCompressionRatio),
+	}
 
-	client, err := client.CreateApidClient(apidURI)
+	dataDir, err := util.WritableDir(v.GetString(ConfigDataDir), path.Join(os.TempDir(), "keymaster"))
+
+	if err != nil {
+		log.Fatalf("Could not create the data dir.  Error is %s", err)
+	}
+
+	v.SetDefault(ConfigStateFile, path.Join(dataDir, "state.json"))
+	v.SetDefault(ConfigOutboxDir, path.Join(dataDir, "outbox"))
+
+	//without a delay an apid that answers straight away would be polled in a hot loop
+	if v.GetInt(ConfigBackoffInitial) <= 0 {
+		log.Fatalf("%s must be at least 1 second", ConfigBackoffInitial)
+	}
+
+	trustedKeysFile := v.GetString(ConfigTrustedKeysFile)
+
+	var trustedKeys []crypto.PublicKey
+
+	if trustedKeysFile != "" {
+		keys, err := util.LoadPublicKeys(trustedKeysFile)
+
+		if err != nil {
+			log.Fatalf("Could not load trusted keys from %s.  Error is %s", trustedKeysFile, err)
+		}
+
+		trustedKeys = keys
+	}
+
+	apiClient, err := client.CreateApidClient(apidURI)
 
 	if err != nil {
 		log.Fatalf("Could not create cache.  Error is %s", err)
 	}
 
-	stageManager := new(nginx.StageManagerImpl)
+	var outbox *client.OutboxClient
+
+	outboxDir := v.GetString(ConfigOutboxDir)
+
+	if outboxDir != "" {
+		outbox, err = client.NewOutboxClient(apiClient, outboxDir, util.NewBackoff(time.Duration(v.GetInt(ConfigBackoffInitial))*time.Second, time.Duration(v.GetInt(ConfigBackoffMax))*time.Second))
+
+		if err != nil {
+			log.Fatalf("Could not create the outbox in %s.  Error is %s", outboxDir, err)
+		}
+
+		apiClient = outbox
+	}
+
+	stageManager := &nginx.StageManagerImpl{
+		BundleCacheDir: bundleCacheDir,
+		Cache:          nginx.NewBundleCache(bundleCacheDir, bundleCacheMaxBytes),
+		UnzipLimits:    unzipLimits,
+		TrustedKeys:    trustedKeys,
+	}
+
+	nginxBinary := v.GetString(ConfigNginxBinary)
 
-	manager := nginx.NewManager(client, stageManager, nginxDir, nginxPid, timeout)
+	if nginxBinary == "" {
+		nginxBinary = nginx.FindBinaryPath(nginxDir)
+	}
+
+	controller := nginx.NewNginxController(nginxDir, nginxPid)
+	controller.Binary = &nginx.Binary{
+		Path:    nginxBinary,
+		Globals: v.GetString(ConfigNginxGlobals),
+		Env:     v.GetStringSlice(ConfigNginxEnv),
+	}
+
+	log.Printf("Running nginx from %s", nginxBinary)
+
+	manager := nginx.NewManager(apiClient, stageManager, nginxDir, nginxPid, timeout)
+	manager.SetProxyController(controller)
+
+	healthCheckTimeout := v.GetInt(ConfigHealthCheckTimeout)
+
+	if healthCheckTimeout > 0 {
+		healthCheckStatusURL := v.GetString(ConfigHealthCheckStatusURL)
+
+		if healthCheckStatusURL == "" {
+			log.Fatalf("%s is required when %s is set", ConfigHealthCheckStatusURL, ConfigHealthCheckTimeout)
+		}
+
+		healthChecker := nginx.NewProbeHealthChecker(healthCheckStatusURL)
+		healthChecker.Timeout = time.Duration(healthCheckTimeout) * time.Second
 
-	//loop forever writing configs
-	for {
+		manager.SetHealthChecker(healthChecker)
+	}
+
+	manager.SetStateFile(v.GetString(ConfigStateFile))
+
+	//carry on with the deployment from before we restarted.  If we can't, the next poll applies the current deployment from scratch
+	err = manager.Restore()
+
+	if err != nil {
+		log.Printf("Unable to restore the previous deployment.  Error is %s", err)
+	}
+
+	adminAddress := v.GetString(ConfigAdminAddress)
+
+	if adminAddress != "" {
+		adminServer := admin.NewServer(manager)
+		adminServer.SetToken(v.GetString(ConfigAdminToken))
+		adminServer.Handle("/metrics", metrics.Handler())
+
+		metrics.RegisterStatus(func() (time.Time, bool) {
+			status := manager.Status()
+			return status.LastAppliedAt, status.NginxRunning
+		})
+
+		go func() {
+			log.Fatalf("Admin API failed.  Error is %s", adminServer.ListenAndServe(adminAddress))
+		}()
+	}
+
+	//SIGTERM or SIGINT stop the loop once the current apply finishes or is abandoned.  A second signal exits immediately
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		cancel()
+
+		sig = <-signals
+		log.Fatalf("Received %s while shutting down, exiting", sig)
+	}()
+
+	//deliver results, including any queued before we restarted.  Anything undelivered when we stop is delivered after the next start
+	if outbox != nil {
+		go outbox.Run(ctx)
+	}
+
+	backoff := util.NewBackoff(time.Duration(v.GetInt(ConfigBackoffInitial))*time.Second, time.Duration(v.GetInt(ConfigBackoffMax))*time.Second)
+	backoff.Jitter = v.GetFloat64(ConfigBackoffJitter)
+
+	//loop until we're signalled writing configs.  The poll blocks in apid until there is a new deployment, so we only need to wait on errors
+	for ctx.Err() == nil {
 
 		log.Printf("Runnig manager")
 
-		err := manager.ApplyDeployment()
+		pollStart := time.Now()
 
-		if err != nil {
-			log.Printf("An error occured when attempting to apply the latest deployment.  Error is %s", err)
+		err := manager.ApplyDeployment(ctx)
+
+		if err == nginx.ErrNoNewDeployment && ctx.Err() == nil {
+			//apid should wait up to the poll timeout for something new.  If it answered straight away, back off rather than polling in a hot loop
+			if time.Since(pollStart) < time.Duration(timeout)*time.Second {
+				delay := backoff.Next()
+
+				log.Printf("apid answered without a new deployment.  Polling again in %s", delay)
+
+				manager.Sleep(ctx, delay)
+			} else {
+				backoff.Reset()
+			}
+		} else if err != nil && ctx.Err() == nil {
+			delay := backoff.Next()
+
+			log.Printf("An error occured when attempting to apply the latest deployment.  Retrying in %s.  Error is %s", delay, err)
+
+			manager.Sleep(ctx, delay)
+		} else {
+			backoff.Reset()
 		}
+	}
+
+	err = manager.Shutdown(v.GetBool(ConfigStopNginxOnExit))
 
-		time.Sleep(time.Second * time.Duration(timeout))
+	if err != nil {
+		log.Fatalf("Unable to stop nginx.  Error is %s", err)
 	}
+
+	log.Printf("Shut down")
 }
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "keymaster"
+
+var (
+	//Polls the polls of apid for deployments, by the status code apid returned.  The code is "error" if there was no response
+	Polls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "polls_total",
+		Help:      "Polls of apid for the current deployment, by response status code.",
+	}, []string{"code"})
+
+	//PollDuration how long polls of apid took, including the time apid held them open
+	PollDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "poll_duration_seconds",
+		Help:      "Time taken to poll apid for the current deployment, including long polls.",
+		Buckets:   []float64{.01, .1, .5, 1, 5, 10, 30, 60, 120},
+	})
+
+	//Deployments the deployments we tried to apply, by result and error code.  The error code is "0" on success
+	Deployments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deployments_total",
+		Help:      "Deployments applied, by result and error code.",
+	}, []string{"result", "error_code"})
+
+	//StageDuration how long it took to fetch, unzip, validate and template a deployment
+	StageDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Time taken to stage a deployment.",
+		Buckets:   prometheus.ExponentialBuckets(.01, 2, 15),
+	})
+
+	//TemplateDuration how long it took to template a staged deployment
+	TemplateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "template_duration_seconds",
+		Help:      "Time taken to template a deployment.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	//NginxDuration how long nginx commands took, by command.  test, reload or start
+	NginxDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "nginx_command_duration_seconds",
+		Help:      "Time taken to run nginx commands, by command.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(Polls, PollDuration, Deployments, StageDuration, TemplateDuration, NginxDuration)
+}
+
+//Since the seconds elapsed since start, for observing durations
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+//ObserveDeployment count a deployment with the error code it failed with.  0 is success
+func ObserveDeployment(errorCode int) {
+	result := "success"
+
+	if errorCode != 0 {
+		result = "fail"
+	}
+
+	Deployments.WithLabelValues(result, strconv.Itoa(errorCode)).Inc()
+}
+
+//RegisterStatus register gauges for the running deployment's age and whether nginx is up.  The status func is called on every scrape.
+//appliedAt is zero if no deployment has been applied
+func RegisterStatus(status func() (appliedAt time.Time, nginxRunning bool)) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deployment_age_seconds",
+		Help:      "Time since the running deployment was applied.  0 if none has been.",
+	}, func() float64 {
+		appliedAt, _ := status()
+
+		if appliedAt.IsZero() {
+			return 0
+		}
+
+		return Since(appliedAt)
+	}))
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "nginx_up",
+		Help:      "1 if nginx is running, 0 otherwise.",
+	}, func() float64 {
+		_, nginxRunning := status()
+
+		if nginxRunning {
+			return 1
+		}
+
+		return 0
+	}))
+}
+
+//Handler serve the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,49 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/30x/keymaster/metrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+
+	//scrape the metrics handler
+	scrape := func() string {
+		req, err := http.NewRequest("GET", "/metrics", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(recorder, req)
+
+		Expect(recorder.Code).Should(Equal(http.StatusOK))
+
+		return recorder.Body.String()
+	}
+
+	It("should count deployments by result and error code", func() {
+		metrics.ObserveDeployment(0)
+		metrics.ObserveDeployment(7)
+		metrics.ObserveDeployment(7)
+
+		output := scrape()
+
+		Expect(output).Should(ContainSubstring(`keymaster_deployments_total{error_code="0",result="success"} 1`))
+		Expect(output).Should(ContainSubstring(`keymaster_deployments_total{error_code="7",result="fail"} 2`))
+	})
+
+	It("should report the status gauges", func() {
+		metrics.RegisterStatus(func() (time.Time, bool) {
+			return time.Now().Add(-time.Minute), true
+		})
+
+		output := scrape()
+
+		Expect(output).Should(ContainSubstring("keymaster_deployment_age_seconds 6"))
+		Expect(output).Should(ContainSubstring("keymaster_nginx_up 1"))
+	})
+})
@@ -0,0 +1,230 @@
+package nginx
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/30x/keymaster/util"
+)
+
+//tmpEntrySuffix marks cache entries that are still being unzipped
+const tmpEntrySuffix = ".tmp"
+
+//BundleCache a cache of unzipped bundles, keyed by bundle id and the sha256 of the bundle zip.
+//Unchanged bundles are hard linked into each new deployment instead of being unzipped again
+type BundleCache struct {
+	dir      string
+	maxBytes int64
+}
+
+//NewBundleCache create a bundle cache in dir.  Least recently used entries are evicted once the cache is larger than maxBytes.  0 means no limit
+func NewBundleCache(dir string, maxBytes int64) *BundleCache {
+	return &BundleCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+}
+
+//Link populate destDir with the contents of zipFile.  The zip is only unzipped, within limits, if the cache has no entry for the bundle id and the zip's content hash
+func (cache *BundleCache) Link(bundleID, zipFile, destDir string, limits util.UnzipLimits) error {
+	hash, err := util.HashFile(zipFile)
+	if err != nil {
+		return err
+	}
+
+	entryDir := path.Join(cache.dir, bundleFileName(bundleID)+"-"+hex.EncodeToString(hash))
+
+	_, err = os.Stat(entryDir)
+
+	if os.IsNotExist(err) {
+		err = cache.add(zipFile, entryDir, limits)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	//mark the entry as recently used so it's the last to be evicted
+	now := time.Now()
+	err = os.Chtimes(entryDir, now, now)
+	if err != nil {
+		return err
+	}
+
+	return linkTree(entryDir, destDir)
+}
+
+//add unzip the zip into a temp dir in the cache, then move it into place so a partially unzipped bundle is never used
+func (cache *BundleCache) add(zipFile, entryDir string, limits util.UnzipLimits) error {
+	err := os.MkdirAll(cache.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := util.MkTempDir(cache.dir, path.Base(entryDir)+tmpEntrySuffix, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = util.UnzipWithLimits(zipFile, tmpDir, limits)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	return os.Rename(tmpDir, entryDir)
+}
+
+//Evict remove the least recently used entries until the cache is within its size limit.  Entries used since keepSince are never removed
+func (cache *BundleCache) Evict(keepSince time.Time) error {
+	if cache.maxBytes <= 0 {
+		return nil
+	}
+
+	fileInfos, err := ioutil.ReadDir(cache.dir)
+	if err != nil {
+		return err
+	}
+
+	entries := cacheEntries{}
+	var total int64
+
+	for _, fileInfo := range fileInfos {
+		if strings.Contains(fileInfo.Name(), tmpEntrySuffix) {
+			continue
+		}
+
+		entryPath := path.Join(cache.dir, fileInfo.Name())
+
+		size, err := diskUsage(entryPath)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, cacheEntry{path: entryPath, size: size, modTime: fileInfo.ModTime()})
+		total += size
+	}
+
+	//oldest first
+	sort.Sort(entries)
+
+	for _, e := range entries {
+		if total <= cache.maxBytes {
+			break
+		}
+
+		if !e.modTime.Before(keepSince) {
+			continue
+		}
+
+		log.Printf("Evicting %s from the bundle cache", e.path)
+
+		err = os.RemoveAll(e.path)
+		if err != nil {
+			return err
+		}
+
+		total -= e.size
+	}
+
+	return nil
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+//cacheEntries sorts entries by least recently used
+type cacheEntries []cacheEntry
+
+func (entries cacheEntries) Len() int           { return len(entries) }
+func (entries cacheEntries) Swap(i, j int)      { entries[i], entries[j] = entries[j], entries[i] }
+func (entries cacheEntries) Less(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) }
+
+//bundleFileName bundle ids can contain anything, don't let them escape the cache dir
+func bundleFileName(bundleID string) string {
+	return strings.Replace(bundleID, "/", "_", -1)
+}
+
+//diskUsage the total size of the files under root
+func diskUsage(root string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(root, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fileInfo.Mode().IsRegular() {
+			size += fileInfo.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+//linkTree recreate the directories of source in dest, hard linking the files.  Falls back to copying if a link can't be created (e.g. across devices)
+func linkTree(source, dest string) error {
+	return filepath.Walk(source, func(sourcePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(source, sourcePath)
+		if err != nil {
+			return err
+		}
+
+		destPath := filepath.Join(dest, relPath)
+
+		switch {
+		case fileInfo.IsDir():
+			return os.MkdirAll(destPath, fileInfo.Mode())
+		case fileInfo.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(sourcePath)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, destPath)
+		}
+
+		if os.Link(sourcePath, destPath) == nil {
+			return nil
+		}
+
+		return copyFile(sourcePath, destPath, fileInfo.Mode())
+	})
+}
+
+func copyFile(source, dest string, mode os.FileMode) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destFile, sourceFile)
+	closeErr := destFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
@@ -0,0 +1,116 @@
+package nginx_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/30x/keymaster/nginx"
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BundleCache", func() {
+
+	var cacheDir string
+
+	BeforeEach(func() {
+		var err error
+		cacheDir, err = ioutil.TempDir("", "bundleCache")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(cacheDir)
+	})
+
+	It("should reuse an unchanged bundle", func() {
+		cache := nginx.NewBundleCache(cacheDir, 0)
+
+		firstDir, err := ioutil.TempDir("", "firstDeployment")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(firstDir)
+
+		secondDir, err := ioutil.TempDir("", "secondDeployment")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(secondDir)
+
+		err = cache.Link("bundle1", "../test/testbundle.zip", firstDir, util.DefaultUnzipLimits)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = cache.Link("bundle1", "../test/testbundle.zip", secondDir, util.DefaultUnzipLimits)
+		Expect(err).NotTo(HaveOccurred())
+
+		//only unzipped once
+		entries, err := ioutil.ReadDir(cacheDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).Should(HaveLen(1))
+
+		//both deployments share the same files
+		firstInfo, err := os.Stat(path.Join(firstDir, "pipes", "apikey.yaml"))
+		Expect(err).NotTo(HaveOccurred())
+
+		secondInfo, err := os.Stat(path.Join(secondDir, "pipes", "apikey.yaml"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.SameFile(firstInfo, secondInfo)).Should(BeTrue())
+	})
+
+	It("should unzip a changed bundle", func() {
+		cache := nginx.NewBundleCache(cacheDir, 0)
+
+		deploymentDir, err := ioutil.TempDir("", "deployment")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(deploymentDir)
+
+		err = cache.Link("bundle1", "../test/testbundle.zip", path.Join(deploymentDir, "first"), util.DefaultUnzipLimits)
+		Expect(err).NotTo(HaveOccurred())
+
+		//same id, different content
+		err = cache.Link("bundle1", "../test/testsystem.zip", path.Join(deploymentDir, "second"), util.DefaultUnzipLimits)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := ioutil.ReadDir(cacheDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).Should(HaveLen(2))
+
+		Expect(path.Join(deploymentDir, "second", "nginx.conf")).Should(BeARegularFile())
+		Expect(path.Join(deploymentDir, "second", "bundle.yaml")).ShouldNot(BeAnExistingFile())
+	})
+
+	It("should evict the least recently used bundles", func() {
+		//smaller than our bundles combined
+		cache := nginx.NewBundleCache(cacheDir, 512)
+
+		deploymentDir, err := ioutil.TempDir("", "deployment")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(deploymentDir)
+
+		err = cache.Link("bundle1", "../test/testbundle.zip", path.Join(deploymentDir, "bundle1"), util.DefaultUnzipLimits)
+		Expect(err).NotTo(HaveOccurred())
+
+		//make sure bundle1 is older
+		past := time.Now().Add(-time.Hour)
+		entries, err := ioutil.ReadDir(cacheDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chtimes(path.Join(cacheDir, entries[0].Name()), past, past)).To(Succeed())
+
+		keepSince := time.Now()
+
+		err = cache.Link("bundle2", "../test/testsystem.zip", path.Join(deploymentDir, "bundle2"), util.DefaultUnzipLimits)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = cache.Evict(keepSince)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err = ioutil.ReadDir(cacheDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).Should(HaveLen(1))
+		Expect(entries[0].Name()).Should(HavePrefix("bundle2-"))
+
+		//evicting doesn't touch deployments already staged
+		Expect(path.Join(deploymentDir, "bundle1", "bundle.yaml")).Should(BeARegularFile())
+	})
+})
@@ -0,0 +1,89 @@
+package nginx
+
+import (
+	"context"
+	"path"
+	"time"
+)
+
+//systemFileName the proxy config at the root of a staged deployment
+const systemFileName = "nginx.conf"
+
+//DefaultStartTimeout how long nginx has to start before it's considered failed
+const DefaultStartTimeout = 5 * time.Second
+
+//ProxyController runs the proxy that serves staged deployments.  The manager only changes the proxy through this, so other gateways can be plugged in.
+//Each staged dir is the output of a StageManager, with its config at the root
+type ProxyController interface {
+	//Validate check the config in the staged dir without applying it.  Returns a *ConfigError if the proxy reports problems with the config
+	Validate(ctx context.Context, stagedDir string) error
+	//Start start the proxy serving the staged dir.  Returns ErrStartTimeout, or a *StartError wrapping it, if the proxy didn't start in time
+	Start(ctx context.Context, stagedDir string) error
+	//Reload switch the running proxy to the staged dir
+	Reload(ctx context.Context, stagedDir string) error
+	//Stop stop the running proxy
+	Stop() error
+	//Status return true if the proxy is running.  The proxy not running is not an error
+	Status() (bool, error)
+}
+
+//NginxController controls an nginx process with a prefix path and a pid file
+type NginxController struct {
+	//PrefixPath the nginx prefix path, passed to -p
+	PrefixPath string
+	//PidFile the pid file nginx writes, used to tell if it's running
+	PidFile string
+	//StartTimeout how long nginx has to start.  Defaults to DefaultStartTimeout
+	StartTimeout time.Duration
+	//Binary the nginx executable to run.  Defaults to DefaultBinary
+	Binary *Binary
+}
+
+//NewNginxController create a controller for nginx with the prefix path and pid file
+func NewNginxController(prefixPath, pidFile string) *NginxController {
+	return &NginxController{
+		PrefixPath:   prefixPath,
+		PidFile:      pidFile,
+		StartTimeout: DefaultStartTimeout,
+	}
+}
+
+//Validate test the nginx.conf in the staged dir
+func (controller *NginxController) Validate(ctx context.Context, stagedDir string) error {
+	return controller.binary().TestConfig(ctx, controller.PrefixPath, path.Join(stagedDir, systemFileName))
+}
+
+//Start start nginx with the nginx.conf in the staged dir
+func (controller *NginxController) Start(ctx context.Context, stagedDir string) error {
+	startTimeout := controller.StartTimeout
+
+	if startTimeout <= 0 {
+		startTimeout = DefaultStartTimeout
+	}
+
+	return controller.binary().Start(ctx, controller.PrefixPath, path.Join(stagedDir, systemFileName), startTimeout)
+}
+
+//Reload signal the running nginx to reload with the nginx.conf in the staged dir
+func (controller *NginxController) Reload(ctx context.Context, stagedDir string) error {
+	return controller.binary().Reload(ctx, controller.PrefixPath, path.Join(stagedDir, systemFileName))
+}
+
+//Stop stop nginx
+func (controller *NginxController) Stop() error {
+	return controller.binary().Stop(controller.PrefixPath)
+}
+
+//Status return true if the process in the pid file is running
+func (controller *NginxController) Status() (bool, error) {
+	return IsRunning(controller.PidFile)
+}
+
+//binary the nginx executable, DefaultBinary if none is set
+func (controller *NginxController) binary() *Binary {
+	if controller.Binary == nil {
+		return DefaultBinary
+	}
+
+	return controller.Binary
+}
@@ -0,0 +1,277 @@
+package nginx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/30x/keymaster/client"
+)
+
+//configMessageRegex matches a message from nginx -t, e.g. nginx: [emerg] unknown directive "foo" in /tmp/deployment/nginx.conf:12
+var configMessageRegex = regexp.MustCompile(`^nginx: \[(emerg|warn)\] (.*?)(?: in (\S+):(\d+))?$`)
+
+//listenRegex matches a listen directive, capturing the address
+var listenRegex = regexp.MustCompile(`^\s*listen\s+([^\s;]+)`)
+
+//serverNameRegex matches a server_name directive, capturing the first name
+var serverNameRegex = regexp.MustCompile(`^\s*server_name\s+([^\s;]+)`)
+
+//ConfigMessage an error or warning reported by nginx when testing a config
+type ConfigMessage struct {
+	//Level emerg or warn
+	Level   string
+	Message string
+	//File the config file the message refers to.  May be empty
+	File string
+	//Line the line in the file the message refers to.  0 if unknown
+	Line int
+}
+
+//ConfigError nginx reported errors or warnings when testing a config
+type ConfigError struct {
+	//Output the complete output of nginx
+	Output   string
+	Messages []ConfigMessage
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Config error:\n%s", e.Output)
+}
+
+//ParseConfigError parse the output of nginx -t.  Returns nil if there are no errors or warnings
+func ParseConfigError(output []byte) *ConfigError {
+	messages := []ConfigMessage{}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		match := configMessageRegex.FindStringSubmatch(strings.TrimSpace(line))
+
+		if match == nil {
+			continue
+		}
+
+		lineNumber, _ := strconv.Atoi(match[4])
+
+		messages = append(messages, ConfigMessage{
+			Level:   match[1],
+			Message: match[2],
+			File:    match[3],
+			Line:    lineNumber,
+		})
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return &ConfigError{
+		Output:   string(output),
+		Messages: messages,
+	}
+}
+
+//BundleErrors attribute each message to the bundles in the staged deployment that produced it.
+//A message is attributed by the bundle directory its file is in, the pipe referenced on or around its line, or the virtual host in a listen directive.
+//Messages we can't attribute to a bundle aren't returned, they're still in the Output
+func (e *ConfigError) BundleErrors(deploymentDir string, deployment *client.Deployment) []client.BundleError {
+	pipes := configPipes(deploymentDir, deployment)
+	fileLines := make(map[string][]string)
+	bundleErrors := []client.BundleError{}
+
+	for _, message := range e.Messages {
+		reason := fmt.Sprintf("[%s] %s", message.Level, message.Message)
+
+		if message.File != "" {
+			reason = fmt.Sprintf("%s in %s:%d", reason, message.File, message.Line)
+		}
+
+		for _, source := range e.findSources(message, deploymentDir, deployment, pipes, fileLines) {
+			bundleReason := reason
+
+			if source.pipeName != "" {
+				bundleReason = fmt.Sprintf("Pipe %s: %s", source.pipeName, reason)
+			}
+
+			bundleErrors = append(bundleErrors, client.BundleError{
+				BundleID:  source.bundleID,
+				ErrorCode: client.ErrorCodeNginxConfigInvalid,
+				Reason:    bundleReason,
+			})
+		}
+	}
+
+	return bundleErrors
+}
+
+//configPipe a pipe as it's referenced in the rendered config
+type configPipe struct {
+	bundleID string
+	pipeName string
+	fqName   *regexp.Regexp
+}
+
+//configPipes the pipes of every bundle, matching their fully qualified name as a whole word.
+//Templates may render it as is or sanitized with upstreamName, so either matches
+func configPipes(deploymentDir string, deployment *client.Deployment) []configPipe {
+	pipes := []configPipe{}
+
+	for _, b := range deployment.Bundles {
+		bundleMetadata, err := readBundleMetadata(filepath.Join(deploymentDir, b.BundleID))
+		if err != nil {
+			continue
+		}
+
+		for _, pipeName := range bundleMetadata.Pipes {
+			fqName := b.BundleID + "_" + pipeName
+			names := regexp.QuoteMeta(fqName) + "|" + regexp.QuoteMeta(upstreamName(fqName))
+
+			pipes = append(pipes, configPipe{
+				bundleID: b.BundleID,
+				pipeName: pipeName,
+				fqName:   regexp.MustCompile(`(^|[^\w-])(` + names + `)($|[^\w-])`),
+			})
+		}
+	}
+
+	return pipes
+}
+
+//findSources find the bundles, and the pipe if we can tell, that the message came from
+func (e *ConfigError) findSources(message ConfigMessage, deploymentDir string, deployment *client.Deployment, pipes []configPipe, fileLines map[string][]string) []configPipe {
+	if message.File == "" || message.Line < 1 {
+		return nil
+	}
+
+	//a file inside a bundle belongs to that bundle
+	relPath, err := filepath.Rel(deploymentDir, message.File)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return nil
+	}
+
+	for _, b := range deployment.Bundles {
+		if strings.HasPrefix(relPath, b.BundleID+string(filepath.Separator)) {
+			return []configPipe{{bundleID: b.BundleID}}
+		}
+	}
+
+	//otherwise it's in a rendered file, look at what the bundles rendered there
+	lines, ok := fileLines[message.File]
+	if !ok {
+		data, err := ioutil.ReadFile(message.File)
+		if err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		fileLines[message.File] = lines
+	}
+
+	if message.Line > len(lines) {
+		return nil
+	}
+
+	line := lines[message.Line-1]
+
+	if sources := pipesIn([]string{line}, pipes); len(sources) > 0 {
+		return sources
+	}
+
+	if match := listenRegex.FindStringSubmatch(line); match != nil {
+		return bundlesListeningOn(match[1], serverName(enclosingBlock(lines, message.Line-1)), deployment)
+	}
+
+	//the pipe referenced in the enclosing block, as long as there's only one
+	sources := pipesIn(enclosingBlock(lines, message.Line-1), pipes)
+	if len(sources) == 1 {
+		return sources
+	}
+
+	return nil
+}
+
+//pipesIn the pipes referenced in the lines
+func pipesIn(lines []string, pipes []configPipe) []configPipe {
+	found := []configPipe{}
+
+	for _, p := range pipes {
+		for _, line := range lines {
+			if p.fqName.MatchString(line) {
+				found = append(found, p)
+				break
+			}
+		}
+	}
+
+	return found
+}
+
+//bundlesListeningOn the bundles with a virtual host served by the listen address and server name, which is empty if the server block has none
+func bundlesListeningOn(listen, serverName string, deployment *client.Deployment) []configPipe {
+	found := []configPipe{}
+
+	listening, err := parseVirtualHost(listen)
+	if err != nil {
+		return found
+	}
+
+	//a listen directive only has a host if it's an IP or localhost, otherwise the server block is picked by name
+	host := listening.host
+	if host == "" {
+		host = strings.ToLower(serverName)
+	}
+
+	for _, b := range deployment.Bundles {
+		for _, virtualHost := range b.VirtualHosts {
+			address, err := parseVirtualHost(virtualHost)
+
+			if err == nil && address.port == listening.port && address.host == host {
+				found = append(found, configPipe{bundleID: b.BundleID})
+				break
+			}
+		}
+	}
+
+	return found
+}
+
+//serverName the first name in the block's server_name directive.  Empty if it doesn't have one
+func serverName(block []string) string {
+	for _, line := range block {
+		if match := serverNameRegex.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+	}
+
+	return ""
+}
+
+//enclosingBlock the lines of the innermost { } block containing the line at index
+func enclosingBlock(lines []string, index int) []string {
+	start := 0
+	depth := 0
+
+	for i := index; i >= 0; i-- {
+		depth += strings.Count(lines[i], "}") - strings.Count(lines[i], "{")
+
+		//more opens than closes, this line opens our block
+		if depth < 0 || (i == index && strings.Contains(lines[i], "{")) {
+			start = i
+			break
+		}
+	}
+
+	end := len(lines) - 1
+	depth = 0
+
+	for i := start; i < len(lines); i++ {
+		depth += strings.Count(lines[i], "{") - strings.Count(lines[i], "}")
+
+		if depth <= 0 && i > start {
+			end = i
+			break
+		}
+	}
+
+	return lines[start : end+1]
+}
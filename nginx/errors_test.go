@@ -0,0 +1,135 @@
+package nginx_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/nginx"
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConfigError", func() {
+
+	It("should parse nginx output", func() {
+		output := "nginx: [warn] conflicting server name \"example.com\" on 0.0.0.0:9000, ignored\n" +
+			"nginx: [emerg] unknown directive \"foo\" in /tmp/deployment/nginx.conf:12\n" +
+			"nginx: configuration file /tmp/deployment/nginx.conf test failed\n"
+
+		configErr := nginx.ParseConfigError([]byte(output))
+		Expect(configErr).NotTo(BeNil())
+		Expect(configErr.Messages).Should(HaveLen(2))
+
+		Expect(configErr.Messages[0]).Should(Equal(nginx.ConfigMessage{Level: "warn", Message: "conflicting server name \"example.com\" on 0.0.0.0:9000, ignored"}))
+		Expect(configErr.Messages[1]).Should(Equal(nginx.ConfigMessage{Level: "emerg", Message: "unknown directive \"foo\"", File: "/tmp/deployment/nginx.conf", Line: 12}))
+
+		Expect(configErr.Error()).Should(ContainSubstring(output))
+	})
+
+	It("should not return an error for a valid config", func() {
+		output := "nginx: the configuration file /tmp/deployment/nginx.conf syntax is ok\n" +
+			"nginx: configuration file /tmp/deployment/nginx.conf test is successful\n"
+
+		Expect(nginx.ParseConfigError([]byte(output))).To(BeNil())
+	})
+
+	It("should attribute errors to bundles", func() {
+		bundles := []*client.DeploymentBundle{
+			{BundleID: "bundle1", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+			{BundleID: "bundle2", BasePath: "basepath2", Target: "http://localhost", VirtualHosts: []string{"localhost:8081"}},
+		}
+
+		deployment := &client.Deployment{
+			ID:      "deployment_id",
+			Bundles: bundles,
+		}
+
+		stageDir, err := util.MkTempDir("", deployment.ID, 0755)
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(stageDir)
+
+		err = copyDirRecursive("../test/template/testsystem", stageDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, b := range bundles {
+			err = copyDirRecursive("../test/template/testbundle", path.Join(stageDir, b.BundleID))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		nginxConf := path.Join(stageDir, "nginx.conf")
+		pipeFile := path.Join(stageDir, "bundle1", "pipes", "dump.yaml")
+
+		//fake what nginx would say about the rendered config
+		output := fmt.Sprintf("nginx: [emerg] invalid number of arguments in \"set\" directive in %s:%d\n", nginxConf, findLine(nginxConf, "\"bundle1_apikey\";")) +
+			fmt.Sprintf("nginx: [emerg] a duplicate listen 127.0.0.1:8081 in %s:%d\n", nginxConf, findLine(nginxConf, "listen localhost:8081;")) +
+			fmt.Sprintf("nginx: [warn] invalid proxy_pass in %s:%d\n", nginxConf, findLine(nginxConf, "\"bundle2_dump\";")+5) +
+			fmt.Sprintf("nginx: [emerg] unexpected end of file in %s:%d\n", pipeFile, 1) +
+			fmt.Sprintf("nginx: [emerg] no \"events\" section in configuration in %s:%d\n", nginxConf, 1)
+
+		configErr := nginx.ParseConfigError([]byte(output))
+		Expect(configErr).NotTo(BeNil())
+
+		bundleErrors := configErr.BundleErrors(stageDir, deployment)
+		Expect(bundleErrors).Should(HaveLen(4))
+
+		Expect(bundleErrors[0].BundleID).Should(Equal("bundle1"))
+		Expect(bundleErrors[0].Reason).Should(HavePrefix("Pipe apikey: [emerg] invalid number of arguments"))
+
+		Expect(bundleErrors[1].BundleID).Should(Equal("bundle2"))
+		Expect(bundleErrors[1].Reason).Should(HavePrefix("[emerg] a duplicate listen 127.0.0.1:8081"))
+
+		Expect(bundleErrors[2].BundleID).Should(Equal("bundle2"))
+		Expect(bundleErrors[2].Reason).Should(HavePrefix("Pipe dump: [warn] invalid proxy_pass"))
+
+		Expect(bundleErrors[3].BundleID).Should(Equal("bundle1"))
+		Expect(bundleErrors[3].Reason).Should(ContainSubstring("pipes/dump.yaml:1"))
+	})
+
+	It("should attribute errors to bundles whose IDs aren't identifiers", func() {
+		deployment := &client.Deployment{
+			ID: "deployment_id",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "my-bundle", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+			},
+		}
+
+		stageDir := stageTemplateFixture(deployment, "../test/template/testbundle")
+		defer os.RemoveAll(stageDir)
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		nginxConf := path.Join(stageDir, "nginx.conf")
+
+		//the template sanitizes the pipe name with upstreamName
+		line := findLine(nginxConf, "\"my_bundle_apikey\";")
+
+		output := fmt.Sprintf("nginx: [emerg] invalid number of arguments in \"set\" directive in %s:%d\n", nginxConf, line)
+
+		bundleErrors := nginx.ParseConfigError([]byte(output)).BundleErrors(stageDir, deployment)
+		Expect(bundleErrors).Should(HaveLen(1))
+		Expect(bundleErrors[0].BundleID).Should(Equal("my-bundle"))
+		Expect(bundleErrors[0].Reason).Should(HavePrefix("Pipe apikey: [emerg] invalid number of arguments"))
+	})
+})
+
+//findLine the 1 based line number of the first line in the file containing text
+func findLine(fileName, text string) int {
+	data, err := ioutil.ReadFile(fileName)
+	Expect(err).NotTo(HaveOccurred())
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, text) {
+			return i + 1
+		}
+	}
+
+	Fail(fmt.Sprintf("%s not found in %s", text, fileName))
+	return 0
+}
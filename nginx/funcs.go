@@ -0,0 +1,156 @@
+package nginx
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//TemplateFuncs the functions available to system templates, in addition to the text/template builtins
+var TemplateFuncs = template.FuncMap{
+	"cleanPath":     cleanPath,
+	"joinPath":      joinPath,
+	"escape":        escape,
+	"quote":         quote,
+	"upstreamName":  upstreamName,
+	"env":           os.Getenv,
+	"default":       defaultValue,
+	"sortedBundles": sortedBundles,
+	"include":       include,
+}
+
+//FragmentFuncs the functions available to bundle fragments.  Bundles are deployed through apid, not by whoever runs keymaster, so they can't read its environment with env
+var FragmentFuncs = template.FuncMap{
+	"cleanPath":     cleanPath,
+	"joinPath":      joinPath,
+	"escape":        escape,
+	"quote":         quote,
+	"upstreamName":  upstreamName,
+	"default":       defaultValue,
+	"sortedBundles": sortedBundles,
+	"include":       include,
+}
+
+//cleanPath normalize a location path.  It always has a leading '/', and never a trailing one unless it's the root
+func cleanPath(location string) string {
+	return path.Clean("/" + location)
+}
+
+//joinPath join the elements into a single location path, e.g. a bundle's base path and a pipe's path
+func joinPath(elements ...string) string {
+	return cleanPath(path.Join(elements...))
+}
+
+//escape escape backslashes and double quotes so the value can be used inside a double quoted nginx string
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+}
+
+//quote the value as a double quoted nginx string
+func quote(value string) string {
+	return `"` + escape(value) + `"`
+}
+
+//upstreamName a name safe to use for an upstream, or anywhere else nginx or lua expects an identifier.
+//Anything other than letters, digits and underscores is replaced with an underscore, and a leading digit is prefixed with one
+func upstreamName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, name)
+
+	if sanitized == "" || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		sanitized = "_" + sanitized
+	}
+
+	return sanitized
+}
+
+//defaultValue the value, or defaultVal if the value is empty.  Reads naturally at the end of a pipeline, {{ env "HOME" | default "/root" }}
+func defaultValue(defaultVal interface{}, value interface{}) interface{} {
+	if isEmpty(value) {
+		return defaultVal
+	}
+
+	return value
+}
+
+//isEmpty true if the value is nil or the zero value of its type, or an empty slice or map
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	reflected := reflect.ValueOf(value)
+
+	switch reflected.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return reflected.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return reflected.IsNil()
+	}
+
+	return reflect.DeepEqual(value, reflect.Zero(reflected.Type()).Interface())
+}
+
+//include an nginx include directive for the bundle's fragment, e.g. {{ include $bundle "location.conf" }} for nginx/location.conf.tmpl.
+//Fragments are optional, so nothing is included if the bundle doesn't have it
+func include(b bundle, name string) string {
+	fragmentFile, ok := b.Fragments[name]
+	if !ok {
+		return ""
+	}
+
+	return "include " + quote(fragmentFile) + ";"
+}
+
+//sortedBundles the bundles ordered by ID, so the rendered config doesn't change with map ordering
+func sortedBundles(bundles map[string]bundle) []bundle {
+	sorted := make(bundlesByID, 0, len(bundles))
+
+	for _, b := range bundles {
+		sorted = append(sorted, b)
+	}
+
+	sort.Sort(sorted)
+
+	return sorted
+}
+
+type bundlesByID []bundle
+
+func (bundles bundlesByID) Len() int           { return len(bundles) }
+func (bundles bundlesByID) Swap(i, j int)      { bundles[i], bundles[j] = bundles[j], bundles[i] }
+func (bundles bundlesByID) Less(i, j int) bool { return bundles[i].ID < bundles[j].ID }
+
+//orderPipes the pipes with the longest path first, so more specific locations come before the ones they'd otherwise be matched by.
+//Pipes with paths of the same length are ordered by name
+func orderPipes(pipes map[string]pipe) []pipe {
+	ordered := make(pipesByPath, 0, len(pipes))
+
+	for _, p := range pipes {
+		ordered = append(ordered, p)
+	}
+
+	sort.Sort(ordered)
+
+	return ordered
+}
+
+type pipesByPath []pipe
+
+func (pipes pipesByPath) Len() int      { return len(pipes) }
+func (pipes pipesByPath) Swap(i, j int) { pipes[i], pipes[j] = pipes[j], pipes[i] }
+func (pipes pipesByPath) Less(i, j int) bool {
+	if len(pipes[i].Path) != len(pipes[j].Path) {
+		return len(pipes[i].Path) > len(pipes[j].Path)
+	}
+
+	return pipes[i].Name < pipes[j].Name
+}
@@ -0,0 +1,144 @@
+package nginx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/30x/keymaster/client"
+)
+
+const (
+	//DefaultHealthCheckTimeout how long we wait for a deployment to come up before it's considered failed
+	DefaultHealthCheckTimeout = 10 * time.Second
+	//DefaultHealthCheckInterval how long we wait between probes
+	DefaultHealthCheckInterval = 250 * time.Millisecond
+)
+
+//HealthChecker verifies a deployment is live after nginx has been reloaded or started with it
+type HealthChecker interface {
+	//Check returns nil once the deployment is live, or an error if it doesn't come up
+	Check(deployment *client.Deployment) error
+}
+
+//ProbeHealthChecker checks the status url reports the deployment, and that every port in the deployment's virtual hosts accepts connections.
+//nginx workers pick up a reload asynchronously, so the probes are retried until they pass or the timeout elapses
+type ProbeHealthChecker struct {
+	//StatusURL the url serving the status of the running deployment, as nginx serves the status file.  Required, it's the only probe that tells the new deployment is live
+	StatusURL string
+	//Timeout how long to keep probing before the check fails
+	Timeout time.Duration
+	//Interval how long to wait between probes
+	Interval time.Duration
+}
+
+//NewProbeHealthChecker create a health checker with the default timeout and interval
+func NewProbeHealthChecker(statusURL string) *ProbeHealthChecker {
+	return &ProbeHealthChecker{
+		StatusURL: statusURL,
+		Timeout:   DefaultHealthCheckTimeout,
+		Interval:  DefaultHealthCheckInterval,
+	}
+}
+
+//Check probe until the deployment is live or the timeout elapses.  Returns the last probe's error on timeout
+func (checker *ProbeHealthChecker) Check(deployment *client.Deployment) error {
+	deadline := time.Now().Add(checker.Timeout)
+
+	for {
+		err := checker.probe(deployment)
+
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(checker.Interval).After(deadline) {
+			return fmt.Errorf("Deployment %s did not become healthy within %s.  %s", deployment.ID, checker.Timeout, err)
+		}
+
+		time.Sleep(checker.Interval)
+	}
+}
+
+//probe check the status url and every address once
+func (checker *ProbeHealthChecker) probe(deployment *client.Deployment) error {
+	if checker.StatusURL == "" {
+		return fmt.Errorf("No status url to check deployment %s", deployment.ID)
+	}
+
+	for _, address := range probeAddresses(deployment) {
+		conn, err := net.DialTimeout("tcp", address, checker.Interval)
+		if err != nil {
+			return fmt.Errorf("Unable to connect to %s.  %s", address, err)
+		}
+
+		conn.Close()
+	}
+
+	statusClient := &http.Client{
+		Timeout: checker.Timeout,
+	}
+
+	res, err := statusClient.Get(checker.StatusURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Status %s returned %d", checker.StatusURL, res.StatusCode)
+	}
+
+	status := &deploymentStatus{}
+
+	err = json.Unmarshal(body, status)
+	if err != nil {
+		return fmt.Errorf("Status %s is not valid.  %s", checker.StatusURL, err)
+	}
+
+	//exactly, deploy-10 running must not pass for deploy-1
+	if status.DeploymentID != deployment.ID {
+		return fmt.Errorf("Status %s does not report deployment %s, it reports %s", checker.StatusURL, deployment.ID, status.DeploymentID)
+	}
+
+	return nil
+}
+
+//probeAddresses the unique addresses to dial for every bundle's virtual hosts.  nginx listens on the port for every host name, so they're dialed on the loopback address.
+//Only a literal IP is dialed as is, nginx listens on just that address
+func probeAddresses(deployment *client.Deployment) []string {
+	addresses := []string{}
+	seen := make(map[string]bool)
+
+	for _, b := range deployment.Bundles {
+		for _, virtualHost := range b.VirtualHosts {
+			listen, err := parseVirtualHost(virtualHost)
+			if err != nil {
+				continue
+			}
+
+			host := "127.0.0.1"
+			if net.ParseIP(listen.host) != nil {
+				host = listen.host
+			}
+
+			address := net.JoinHostPort(host, strconv.Itoa(listen.port))
+
+			if !seen[address] {
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses
+}
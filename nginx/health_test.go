@@ -0,0 +1,135 @@
+package nginx_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/nginx"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ProbeHealthChecker", func() {
+
+	var listener net.Listener
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	//deploymentOn a deployment with a bundle listening on the address
+	deploymentOn := func(address string) *client.Deployment {
+		return &client.Deployment{
+			ID: "deployment_id",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "bundle1", VirtualHosts: []string{address}},
+			},
+		}
+	}
+
+	newChecker := func(statusURL string) *nginx.ProbeHealthChecker {
+		checker := nginx.NewProbeHealthChecker(statusURL)
+		checker.Timeout = 500 * time.Millisecond
+		checker.Interval = 50 * time.Millisecond
+		return checker
+	}
+
+	//statusServerFor a status url that reports the deployment
+	statusServerFor := func(deploymentID string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"deploymentId": "%s"}`, deploymentID)
+		}))
+	}
+
+	It("should pass when every virtual host accepts connections", func() {
+		deployment := deploymentOn(listener.Addr().String())
+
+		statusServer := statusServerFor(deployment.ID)
+		defer statusServer.Close()
+
+		Expect(newChecker(statusServer.URL).Check(deployment)).To(Succeed())
+	})
+
+	It("should fail when a virtual host is not listening", func() {
+		address := listener.Addr().String()
+		listener.Close()
+
+		statusServer := statusServerFor("deployment_id")
+		defer statusServer.Close()
+
+		err := newChecker(statusServer.URL).Check(deploymentOn(address))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("did not become healthy"))
+	})
+
+	It("should fail without a status url", func() {
+		err := newChecker("").Check(deploymentOn(listener.Addr().String()))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("No status url"))
+	})
+
+	It("should probe named virtual hosts on the loopback address", func() {
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+
+		statusServer := statusServerFor("deployment_id")
+		defer statusServer.Close()
+
+		//doesn't resolve, nginx listens on the port for every name anyway
+		deployment := deploymentOn("api.keymaster.invalid:" + port)
+
+		Expect(newChecker(statusServer.URL).Check(deployment)).To(Succeed())
+	})
+
+	It("should check the status url reports the deployment", func() {
+		runningID := "previous"
+
+		statusServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"deploymentId": "%s"}`, runningID)
+		}))
+		defer statusServer.Close()
+
+		deployment := deploymentOn(listener.Addr().String())
+
+		err := newChecker(statusServer.URL).Check(deployment)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("does not report deployment deployment_id"))
+
+		runningID = deployment.ID
+		Expect(newChecker(statusServer.URL).Check(deployment)).To(Succeed())
+	})
+
+	It("should require the status to report exactly the deployment", func() {
+		deployment := deploymentOn(listener.Addr().String())
+		deployment.ID = "deploy-1"
+
+		//the ID we're checking for is a prefix of the running one
+		statusServer := statusServerFor("deploy-10")
+		defer statusServer.Close()
+
+		err := newChecker(statusServer.URL).Check(deployment)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("does not report deployment deploy-1"))
+	})
+
+	It("should fail when the status isn't JSON", func() {
+		statusServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "deployment_id")
+		}))
+		defer statusServer.Close()
+
+		err := newChecker(statusServer.URL).Check(deploymentOn(listener.Addr().String()))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("is not valid"))
+	})
+})
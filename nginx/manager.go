@@ -1,56 +1,317 @@
 package nginx
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/metrics"
 )
 
+//ErrNoNewDeployment returned by ApplyDeployment when apid had nothing to apply, only the deployment we're running or one that already failed.
+//It isn't a failure, but apid should have waited for something new, so if it answers straight away the caller should back off before polling again
+var ErrNoNewDeployment = errors.New("No new deployment to apply")
+
 //Manager The config manager
 type Manager struct {
 	client       client.ApidClient
-	nginxPidFile string
-	nginxWorkDir string
 	pollTimeout  int
 	stageManager StageManager
+	controller   ProxyController
+
+	//healthChecker verifies a deployment is live once applied.  Optional
+	healthChecker HealthChecker
+	//stateFile where the running deployment is persisted.  Optional
+	stateFile string
+
+	//applyMutex held while nginx is being changed, so an admin rollback can't interleave with a deployment
+	applyMutex sync.Mutex
+	//mutex guards the state below, which is read by Status while a deployment is applied
+	mutex sync.RWMutex
+	//wake signals a paused or sleeping manager to poll now
+	wake chan struct{}
 
 	//state of last successful deployment
 	lastApidDeployment     *client.Deployment
 	lastUnzippedDeployment string
+	lastAppliedAt          time.Time
+
+	//the successful deployment before the last, kept so we can roll back to it
+	previousApidDeployment     *client.Deployment
+	previousUnzippedDeployment string
+
+	//the last deployment that failed.  It isn't retried until apid has a newer one, or a poll is requested
+	failedDeployment *client.Deployment
+
+	lastError   string
+	lastErrorAt time.Time
+	paused      bool
+	forcePoll   bool
 }
 
-//NewManager Create a new instance of the configuration manager
+//ManagerStatus a snapshot of the deployment the manager is running
+type ManagerStatus struct {
+	DeploymentID         string    `json:"deploymentId"`
+	ETag                 string    `json:"etag"`
+	StagedDir            string    `json:"stagedDir"`
+	LastAppliedAt        time.Time `json:"lastAppliedAt"`
+	PreviousDeploymentID string    `json:"previousDeploymentId"`
+	FailedDeploymentID   string    `json:"failedDeploymentId"`
+	LastError            string    `json:"lastError"`
+	LastErrorAt          time.Time `json:"lastErrorAt"`
+	NginxRunning         bool      `json:"nginxRunning"`
+	Paused               bool      `json:"paused"`
+}
+
+//NewManager Create a new instance of the configuration manager, running nginx with the work dir and pid file
 func NewManager(apiClient client.ApidClient, stageManager StageManager, nginxWorkDir string, nginxPidFile string, pollTimeout int) *Manager {
 	return &Manager{
 		client:       apiClient,
 		stageManager: stageManager,
-		nginxWorkDir: nginxWorkDir,
-		nginxPidFile: nginxPidFile,
+		controller:   NewNginxController(nginxWorkDir, nginxPidFile),
 		pollTimeout:  pollTimeout,
+		wake:         make(chan struct{}, 1),
 	}
 }
 
-//ApplyDeployment Runs once, attempting to apply the latest deployment from the bundle cache. May return an execution error if there is a problem executing
-func (manager *Manager) ApplyDeployment() error {
+//SetProxyController run deployments with the controller instead of nginx.  Must be called before the manager is used
+func (manager *Manager) SetProxyController(controller ProxyController) {
+	manager.controller = controller
+}
 
-	etag := ""
+//SetHealthChecker verify every deployment with the checker after nginx is reloaded or started.  A deployment that fails the check is rolled back
+func (manager *Manager) SetHealthChecker(healthChecker HealthChecker) {
+	manager.healthChecker = healthChecker
+}
+
+//Status a snapshot of what the manager is running.  Safe to call while a deployment is being applied
+func (manager *Manager) Status() ManagerStatus {
+	manager.mutex.RLock()
+
+	status := ManagerStatus{
+		StagedDir:     manager.lastUnzippedDeployment,
+		LastAppliedAt: manager.lastAppliedAt,
+		LastError:     manager.lastError,
+		LastErrorAt:   manager.lastErrorAt,
+		Paused:        manager.paused,
+	}
 
 	if manager.lastApidDeployment != nil {
+		status.DeploymentID = manager.lastApidDeployment.ID
+		status.ETag = manager.lastApidDeployment.ETAG
+	}
+
+	if manager.previousApidDeployment != nil {
+		status.PreviousDeploymentID = manager.previousApidDeployment.ID
+	}
+
+	if manager.failedDeployment != nil {
+		status.FailedDeploymentID = manager.failedDeployment.ID
+	}
+
+	manager.mutex.RUnlock()
+
+	isRunning, err := manager.controller.Status()
+	if err != nil {
+		log.Printf("Unable to determine if the proxy is running.  Error is %s", err)
+	}
+
+	status.NginxRunning = isRunning
+
+	return status
+}
+
+//Pause stop applying deployments until Resume is called.  A deployment that's being applied is finished
+func (manager *Manager) Pause() {
+	manager.mutex.Lock()
+	manager.paused = true
+	manager.mutex.Unlock()
+
+	log.Printf("Applying deployments is paused")
+}
+
+//Resume start applying deployments again after Pause
+func (manager *Manager) Resume() {
+	manager.mutex.Lock()
+	manager.paused = false
+	manager.mutex.Unlock()
+
+	log.Printf("Applying deployments is resumed")
+
+	manager.signalWake()
+}
+
+//RequestPoll poll apid for the current deployment immediately, rather than waiting for a new one.  A poll already in progress is finished first.
+//The current deployment is applied even if it has already failed
+func (manager *Manager) RequestPoll() {
+	manager.mutex.Lock()
+	manager.forcePoll = true
+	manager.mutex.Unlock()
+
+	manager.signalWake()
+}
+
+//Sleep wait for the duration, or until a poll is requested, the manager is resumed or ctx is cancelled
+func (manager *Manager) Sleep(ctx context.Context, duration time.Duration) {
+	select {
+	case <-manager.wake:
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+}
+
+//Rollback re-apply the deployment before the current one.  Applying deployments is paused, otherwise the next poll would apply the current deployment again.
+//Resume to apply the latest deployment from apid
+func (manager *Manager) Rollback() error {
+	manager.applyMutex.Lock()
+	defer manager.applyMutex.Unlock()
+
+	if manager.previousApidDeployment == nil || manager.previousUnzippedDeployment == "" {
+		return errors.New("There is no previous deployment to roll back to")
+	}
+
+	_, err := manager.reloadOrStart(context.Background(), manager.previousUnzippedDeployment)
+
+	if err != nil {
+		manager.recordError(err)
+		return err
+	}
+
+	//swap them, so rolling back again returns to the deployment we just left
+	manager.mutex.Lock()
+	manager.lastApidDeployment, manager.previousApidDeployment = manager.previousApidDeployment, manager.lastApidDeployment
+	manager.lastUnzippedDeployment, manager.previousUnzippedDeployment = manager.previousUnzippedDeployment, manager.lastUnzippedDeployment
+	manager.lastAppliedAt = time.Now()
+	manager.paused = true
+	manager.mutex.Unlock()
+
+	manager.saveState()
+
+	log.Printf("Rolled back to deployment %s.  Applying deployments is paused", manager.lastApidDeployment.ID)
+
+	return nil
+}
+
+//ApplyDeployment Runs once, attempting to apply the latest deployment from the bundle cache. May return an execution error if there is a problem executing.
+//If the manager is paused, waits up to the poll timeout to be resumed instead.
+//Cancelling ctx abandons the poll, staging and config test, removing the staged deployment and returning ctx.Err().  Once nginx is being changed the apply is finished,
+//so nginx is never left between deployments
+func (manager *Manager) ApplyDeployment(ctx context.Context) error {
+	if manager.isPaused() {
+		manager.Sleep(ctx, time.Duration(manager.pollTimeout)*time.Second)
+		return nil
+	}
+
+	err := manager.applyDeployment(ctx)
+
+	if err != nil && err != ctx.Err() && err != ErrNoNewDeployment {
+		manager.recordError(err)
+	}
+
+	return err
+}
+
+//Shutdown stop managing nginx once ApplyDeployment has returned for the last time.
+//If stopNginx is set nginx is stopped, if it's running, and the staged deployments are removed, otherwise nginx is left running the current deployment
+func (manager *Manager) Shutdown(stopNginx bool) error {
+	manager.applyMutex.Lock()
+	defer manager.applyMutex.Unlock()
+
+	if !stopNginx {
+		if manager.lastApidDeployment != nil {
+			log.Printf("Leaving nginx running deployment %s in %s", manager.lastApidDeployment.ID, manager.lastUnzippedDeployment)
+		}
+
+		return nil
+	}
+
+	isRunning, err := manager.controller.Status()
+	if err != nil {
+		return err
+	}
+
+	//already stopped, e.g. it was never started or exited on its own
+	if isRunning {
+		err = manager.controller.Stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	manager.mutex.Lock()
+	stagedDirs := []string{manager.lastUnzippedDeployment, manager.previousUnzippedDeployment}
+	manager.lastApidDeployment = nil
+	manager.lastUnzippedDeployment = ""
+	manager.previousApidDeployment = nil
+	manager.previousUnzippedDeployment = ""
+	manager.mutex.Unlock()
+
+	for _, stagedDir := range stagedDirs {
+		manager.removeStaged(stagedDir)
+	}
+
+	manager.clearState()
+
+	return nil
+}
+
+func (manager *Manager) applyDeployment(ctx context.Context) error {
+
+	etag := ""
+
+	manager.mutex.Lock()
+
+	//wait for something newer than what we last tried, whether it succeeded or failed.
+	//A forced poll asks for the current deployment without an etag, so apid answers immediately, and retries it even if it failed
+	if manager.forcePoll {
+		manager.failedDeployment = nil
+	} else if manager.failedDeployment != nil {
+		etag = manager.failedDeployment.ETAG
+	} else if manager.lastApidDeployment != nil {
 		etag = manager.lastApidDeployment.ETAG
 	}
 
-	deployment, err := manager.client.PollDeployments(etag, manager.pollTimeout)
+	manager.forcePoll = false
+	failedDeployment := manager.failedDeployment
+	manager.mutex.Unlock()
+
+	deployment, err := manager.client.PollDeployments(ctx, etag, manager.pollTimeout)
+
+	//we're shutting down
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	//apid has nothing newer than what we're running
+	if err == client.ErrNotModified {
+		return ErrNoNewDeployment
+	}
 
 	if err != nil {
 		return err
 	}
 
+	manager.applyMutex.Lock()
+	defer manager.applyMutex.Unlock()
+
+	//paused while we were polling
+	if manager.isPaused() {
+		return nil
+	}
+
 	//same deployment as last time, do nothing
 	if manager.lastApidDeployment != nil && deployment.ID == manager.lastApidDeployment.ID {
-		return nil
+		return ErrNoNewDeployment
+	}
+
+	//it failed last time, don't retry until there's a new one
+	if failedDeployment != nil && deployment.ID == failedDeployment.ID {
+		return ErrNoNewDeployment
 	}
 
 	//we have a new deployment, time to apply it
@@ -58,78 +319,230 @@ func (manager *Manager) ApplyDeployment() error {
 
 	//unzip bundles to bundle id directlry
 
-	unzippedDir, deploymentError := manager.stageManager.Stage(deployment)
+	stageStart := time.Now()
+	unzippedDir, deploymentError := manager.stageManager.Stage(ctx, deployment)
+	metrics.StageDuration.Observe(metrics.Since(stageStart))
+
+	//abandoned, this isn't a failure of the deployment so apid isn't told
+	if ctx.Err() != nil {
+		manager.removeStaged(unzippedDir)
+		return ctx.Err()
+	}
 
 	if deploymentError != nil {
+		manager.removeStaged(unzippedDir)
 		manager.setDeploymentStatus(deployment, deploymentError)
-		return err
+		return errors.New(deploymentError.Reason)
 	}
 
 	//perform template processing
 
-	//test nginx with the processed templates/new configs.  TODO warnings constitute a failure
+	//test nginx with the processed templates/new configs
 
-	systemFile := fmt.Sprintf("%s/%s", unzippedDir, "nginx.conf")
-	err = TestConfig(manager.nginxWorkDir, systemFile)
+	testStart := time.Now()
+	err = manager.controller.Validate(ctx, unzippedDir)
+	metrics.NginxDuration.WithLabelValues("test").Observe(metrics.Since(testStart))
+
+	if ctx.Err() != nil {
+		manager.removeStaged(unzippedDir)
+		return ctx.Err()
+	}
 
 	if err != nil {
-		manager.signalError(deployment, err)
+		deploymentError := &client.DeploymentError{
+			ErrorCode: client.ErrorCodeNginxConfigInvalid,
+			Reason:    err.Error(),
+		}
+
+		//tell apid which bundles broke the config
+		if configErr, ok := err.(*ConfigError); ok {
+			deploymentError.BundleErrors = configErr.BundleErrors(unzippedDir, deployment)
+		}
+
+		manager.removeStaged(unzippedDir)
+		manager.setDeploymentStatus(deployment, deploymentError)
 		return err
 	}
 
 	//reload or start nginx if not running
-	//TODO detect start state from PID
 
-	isRunning, err := IsRunning(manager.nginxPidFile)
+	//from here on we finish, even if we're shutting down
+	errorCode, err := manager.reloadOrStart(context.Background(), unzippedDir)
 
 	if err != nil {
-		manager.signalError(deployment, err)
+		manager.signalRollback(deployment, unzippedDir, errorCode, err)
 
 		return err
 	}
 
-	if isRunning {
-		err = Reload(manager.nginxWorkDir, systemFile)
-	} else {
-		err = Start(manager.nginxWorkDir, systemFile, 5*time.Second)
-	}
+	//nginx accepted the config, make sure it's actually serving it before we report success
+	if manager.healthChecker != nil {
+		err = manager.healthChecker.Check(deployment)
 
-	if err != nil {
-		manager.signalError(deployment, err)
+		if err != nil {
+			manager.signalRollback(deployment, unzippedDir, client.ErrorCodeHealthCheckFailed, err)
 
-		return err
+			return err
+		}
 	}
 
-	//reset pointers to last for our next invocation
+	//reset pointers to last for our next invocation, keeping the last as the one we can roll back to
+
+	manager.mutex.Lock()
 
-	previousUnzipped := manager.lastUnzippedDeployment
+	staleUnzipped := manager.previousUnzippedDeployment
 
+	manager.previousApidDeployment = manager.lastApidDeployment
+	manager.previousUnzippedDeployment = manager.lastUnzippedDeployment
 	manager.lastApidDeployment = deployment
 	manager.lastUnzippedDeployment = unzippedDir
+	manager.lastAppliedAt = time.Now()
+	manager.failedDeployment = nil
 
-	//cleanup old last from file system
-	err = os.RemoveAll(previousUnzipped)
+	manager.mutex.Unlock()
 
-	//swallow this error, it shouldn't blow up our process
-	if err != nil {
-		log.Printf("Unable to remove directory %s.  Error is %s", previousUnzipped, err)
+	manager.saveState()
+
+	//cleanup the one before that from the file system
+	if staleUnzipped != unzippedDir && staleUnzipped != manager.previousUnzippedDeployment {
+		manager.removeStaged(staleUnzipped)
 	}
 
 	manager.setDeploymentStatus(deployment, nil)
-	//TODO add a template where the deployment.ID is returned at localhost:5280/ to validate we're actually running and get the status of the system
 
 	return nil
 
 }
 
-func (manager *Manager) signalError(deployment *client.Deployment, err error) {
+//reloadOrStart reload the proxy with the staged dir, or start it if it isn't running.  On failure returns the error code to report
+func (manager *Manager) reloadOrStart(ctx context.Context, stagedDir string) (int, error) {
+	isRunning, err := manager.controller.Status()
+
+	if err != nil {
+		return client.ErrorCodeInternal, err
+	}
+
+	if isRunning {
+		reloadStart := time.Now()
+		err = manager.controller.Reload(ctx, stagedDir)
+		metrics.NginxDuration.WithLabelValues("reload").Observe(metrics.Since(reloadStart))
+
+		if err != nil {
+			return client.ErrorCodeNginxReloadFailed, err
+		}
+
+		manager.markApplied(stagedDir)
+
+		return 0, nil
+	}
+
+	startStart := time.Now()
+	err = manager.controller.Start(ctx, stagedDir)
+	metrics.NginxDuration.WithLabelValues("start").Observe(metrics.Since(startStart))
+
+	if err == ErrStartTimeout {
+		return client.ErrorCodeTimeout, err
+	}
+
+	if startErr, ok := err.(*StartError); ok && startErr.Err == ErrStartTimeout {
+		return client.ErrorCodeTimeout, err
+	}
+
+	if err != nil {
+		return client.ErrorCodeNginxStartFailed, err
+	}
+
+	manager.markApplied(stagedDir)
+
+	return 0, nil
+}
+
+//markApplied record in the staged dir's status that the proxy is now serving it
+func (manager *Manager) markApplied(stagedDir string) {
+	err := setStatusAppliedAt(stagedDir, time.Now())
+
+	//the proxy is serving it regardless, the status is just out of date
+	if err != nil {
+		log.Printf("Unable to update the status in %s.  Error is %s", stagedDir, err)
+	}
+}
+
+//rollback re-apply the last good deployment after a new one failed to apply, so nginx isn't left running a broken or partial config.
+//Returns the ID of the deployment we rolled back to
+func (manager *Manager) rollback() (string, error) {
+	if manager.lastApidDeployment == nil || manager.lastUnzippedDeployment == "" {
+		return "", errors.New("There is no previous deployment to roll back to")
+	}
+
+	_, err := manager.reloadOrStart(context.Background(), manager.lastUnzippedDeployment)
+
+	if err != nil {
+		return "", err
+	}
+
+	return manager.lastApidDeployment.ID, nil
+}
+
+//signalRollback roll back to the last good deployment, then report the failure and the outcome of the rollback to apid.
+//Once we've rolled back the failed deployment's staged dir is removed.  If the rollback failed it's kept, nginx may still be serving it
+func (manager *Manager) signalRollback(deployment *client.Deployment, stagedDir string, errorCode int, err error) {
 	deploymentError := &client.DeploymentError{
-		ErrorCode: client.ErrorCodeTODO,
-		Reason:    err.Error(),
+		ErrorCode: errorCode,
+	}
+
+	rolledBackTo, rollbackErr := manager.rollback()
+
+	if rollbackErr != nil {
+		log.Printf("Unable to roll back after deployment %s failed.  Error is %s", deployment.ID, rollbackErr)
+		deploymentError.Reason = fmt.Sprintf("%s.  Rollback failed.  %s", err, rollbackErr)
+	} else {
+		log.Printf("Rolled back to deployment %s after deployment %s failed", rolledBackTo, deployment.ID)
+		deploymentError.Reason = fmt.Sprintf("%s.  Rolled back to deployment %s", err, rolledBackTo)
+		deploymentError.RolledBackTo = rolledBackTo
+
+		if stagedDir != manager.lastUnzippedDeployment && stagedDir != manager.previousUnzippedDeployment {
+			manager.removeStaged(stagedDir)
+		}
 	}
 
 	manager.setDeploymentStatus(deployment, deploymentError)
+}
+
+//removeStaged remove a staged deployment from the file system
+func (manager *Manager) removeStaged(stagedDir string) {
+	if stagedDir == "" {
+		return
+	}
+
+	err := os.RemoveAll(stagedDir)
 
+	//swallow this error, it shouldn't blow up our process
+	if err != nil {
+		log.Printf("Unable to remove directory %s.  Error is %s", stagedDir, err)
+	}
+}
+
+func (manager *Manager) isPaused() bool {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	return manager.paused
+}
+
+//recordError remember the error for Status
+func (manager *Manager) recordError(err error) {
+	manager.mutex.Lock()
+	manager.lastError = err.Error()
+	manager.lastErrorAt = time.Now()
+	manager.mutex.Unlock()
+}
+
+//signalWake wake the manager if it's sleeping.  Doesn't block if it's already been signalled
+func (manager *Manager) signalWake() {
+	select {
+	case manager.wake <- struct{}{}:
+	default:
+	}
 }
 
 func (manager *Manager) setDeploymentStatus(deployment *client.Deployment, err *client.DeploymentError) {
@@ -138,18 +551,28 @@ func (manager *Manager) setDeploymentStatus(deployment *client.Deployment, err *
 		Status: client.StatusSuccess,
 	}
 
+	errorCode := 0
+
 	if err != nil {
 
 		deploymentResult.Error = err
 		deploymentResult.Status = client.StatusFail
+		errorCode = err.ErrorCode
+
+		manager.recordError(fmt.Errorf("Deployment %s failed.  %s", deployment.ID, err.Reason))
 
+		manager.mutex.Lock()
+		manager.failedDeployment = deployment
+		manager.mutex.Unlock()
 	}
 
+	metrics.ObserveDeployment(errorCode)
+
 	setErr := manager.client.SetDeploymentResult(deploymentResult)
 
+	//with an outbox this only fails if the result can't be queued on disk
 	if setErr != nil {
-		log.Printf("Error calling apid. Not setting failure %s", setErr)
-		//TODO if we can't set our status, should we fail here and restart?
+		log.Printf("Error calling apid. Not setting result of deployment %s.  %s", deployment.ID, setErr)
 	}
 }
 
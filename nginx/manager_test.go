@@ -1,11 +1,18 @@
 package nginx_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/30x/keymaster/client"
 	"github.com/30x/keymaster/nginx"
@@ -71,7 +78,7 @@ var _ = Describe("Manager", func() {
 
 		manager := nginx.NewManager(apiClient, stager, nginxDir, nginxPidFile, 1)
 
-		err = manager.ApplyDeployment()
+		err = manager.ApplyDeployment(context.Background())
 
 		//no error with valid bundle
 		Expect(err).Should(BeNil())
@@ -115,7 +122,7 @@ var _ = Describe("Manager", func() {
 
 			manager := nginx.NewManager(apiClient, stager, nginxDir, nginxPidFile, 1)
 
-			err := manager.ApplyDeployment()
+			err := manager.ApplyDeployment(context.Background())
 
 			//no error with valid bundle
 			Expect(err).Should(BeNil())
@@ -128,6 +135,463 @@ var _ = Describe("Manager", func() {
 
 	})
 
+	It("Not Modified", func() {
+
+		//wire up the resposne.  Nothing new from apid
+		apiClient := &apiClientTester{
+			pollDeploymentsErr: client.ErrNotModified,
+		}
+
+		stager := &stageTester{
+			err: &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: "Should not stage"},
+		}
+
+		manager := nginx.NewManager(apiClient, stager, "", nginxPidFile, 1)
+
+		err := manager.ApplyDeployment(context.Background())
+
+		//not modified is not a failure, and we should not report anything to apid
+		Expect(err).Should(Equal(nginx.ErrNoNewDeployment))
+		Expect(manager.Status().LastError).Should(BeEmpty())
+		Expect(apiClient.deploymentResult).Should(BeNil())
+	})
+
+	It("Paused", func() {
+
+		deployment := &client.Deployment{
+			ID: "deployment_id_paused",
+		}
+
+		apiClient := &apiClientTester{
+			mockDeployment: deployment,
+		}
+
+		stager := &stageTester{
+			err: &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: "Should not stage"},
+		}
+
+		manager := nginx.NewManager(apiClient, stager, "", nginxPidFile, 1)
+		manager.Pause()
+
+		Expect(manager.Status().Paused).Should(BeTrue())
+
+		//paused managers wait to be resumed instead of applying
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			manager.Resume()
+		}()
+
+		err := manager.ApplyDeployment(context.Background())
+
+		Expect(err).Should(BeNil())
+		Expect(apiClient.deploymentResult).Should(BeNil())
+		Expect(manager.Status().Paused).Should(BeFalse())
+	})
+
+	It("Status Records Failures", func() {
+
+		deployment := &client.Deployment{
+			ID: "deployment_id_failed",
+		}
+
+		apiClient := &apiClientTester{
+			mockDeployment: deployment,
+		}
+
+		stageDir, err := util.MkTempDir("", deployment.ID, 0755)
+
+		Expect(err).Should(BeNil())
+
+		defer os.RemoveAll(stageDir)
+
+		//the bundles that were fetched before the failure are staged
+		stager := &stageTester{
+			testConfigDir: stageDir,
+			err:           &client.DeploymentError{ErrorCode: client.ErrorCodeDownloadFailed, Reason: "Unable to fetch 1 bundle(s)"},
+		}
+
+		manager := nginx.NewManager(apiClient, stager, "", nginxPidFile, 1)
+
+		err = manager.ApplyDeployment(context.Background())
+
+		Expect(err).Should(MatchError("Unable to fetch 1 bundle(s)"))
+		Expect(stageDir).ShouldNot(BeADirectory())
+		Expect(apiClient.deploymentResult.Status).Should(Equal(client.StatusFail))
+
+		status := manager.Status()
+		Expect(status.DeploymentID).Should(BeEmpty())
+		Expect(status.LastError).Should(ContainSubstring("Unable to fetch 1 bundle(s)"))
+		Expect(status.LastErrorAt.IsZero()).Should(BeFalse())
+
+		//nothing has been applied, so there's nothing to roll back to
+		Expect(manager.Rollback()).ShouldNot(Succeed())
+	})
+
+	It("Cancelled While Staging", func() {
+
+		deployment := &client.Deployment{
+			ID: "deployment_id_cancelled",
+		}
+
+		apiClient := &apiClientTester{
+			mockDeployment: deployment,
+		}
+
+		stageDir, err := util.MkTempDir("", deployment.ID, 0755)
+
+		Expect(err).Should(BeNil())
+
+		defer os.RemoveAll(stageDir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		//we're signalled to shut down part way through staging
+		stager := &stageTester{
+			testConfigDir: stageDir,
+			onStage:       cancel,
+		}
+
+		manager := nginx.NewManager(apiClient, stager, "", nginxPidFile, 1)
+
+		err = manager.ApplyDeployment(ctx)
+
+		//abandoning the deployment isn't a failure, apid isn't told and the staged dir is cleaned up
+		Expect(err).Should(Equal(context.Canceled))
+		Expect(apiClient.deploymentResult).Should(BeNil())
+		Expect(stageDir).ShouldNot(BeADirectory())
+		Expect(manager.Status().LastError).Should(BeEmpty())
+	})
+
+	It("Failed Deployment Not Retried", func() {
+
+		deployment := &client.Deployment{
+			ID:   "deployment_id_broken",
+			ETAG: "deployment_id_broken-1",
+		}
+
+		apiClient := &apiClientTester{
+			mockDeployment: deployment,
+		}
+
+		stager := &stageTester{
+			err: &client.DeploymentError{ErrorCode: client.ErrorCodeBundleInvalid, Reason: "No pipes are defined in bundle.yaml"},
+		}
+
+		manager := nginx.NewManager(apiClient, stager, "", nginxPidFile, 1)
+
+		manager.ApplyDeployment(context.Background())
+
+		Expect(stager.stages).Should(Equal(1))
+		Expect(apiClient.deploymentResult.Status).Should(Equal(client.StatusFail))
+		Expect(manager.Status().FailedDeploymentID).Should(Equal(deployment.ID))
+
+		//we wait for something newer than the failed deployment, and don't retry it
+		apiClient.deploymentResult = nil
+
+		Expect(manager.ApplyDeployment(context.Background())).Should(Equal(nginx.ErrNoNewDeployment))
+
+		Expect(apiClient.polledETag).Should(Equal(deployment.ETAG))
+		Expect(stager.stages).Should(Equal(1))
+		Expect(apiClient.deploymentResult).Should(BeNil())
+
+		//unless we're asked to
+		manager.RequestPoll()
+		manager.ApplyDeployment(context.Background())
+
+		Expect(apiClient.polledETag).Should(BeEmpty())
+		Expect(stager.stages).Should(Equal(2))
+		Expect(apiClient.deploymentResult.Status).Should(Equal(client.StatusFail))
+	})
+
+	Describe("Proxy Controller", func() {
+
+		var tmpDir string
+		var proxy *proxyTester
+		var apiClient *apiClientTester
+		var stager *stageTester
+		var manager *nginx.Manager
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = util.MkTempDir("", "controller", 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			proxy = &proxyTester{}
+			apiClient = &apiClientTester{}
+			stager = &stageTester{}
+
+			manager = nginx.NewManager(apiClient, stager, "", "", 1)
+			manager.SetProxyController(proxy)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		//apply stage the deployment in its own dir and apply it
+		apply := func(deploymentID string) (string, error) {
+			stagedDir := filepath.Join(tmpDir, deploymentID)
+			Expect(os.Mkdir(stagedDir, 0755)).To(Succeed())
+
+			stager.testConfigDir = stagedDir
+			apiClient.mockDeployment = &client.Deployment{ID: deploymentID}
+
+			return stagedDir, manager.ApplyDeployment(context.Background())
+		}
+
+		It("should start the proxy, then reload it", func() {
+			firstDir, err := apply("deployment_id_first")
+			Expect(err).Should(BeNil())
+
+			secondDir, err := apply("deployment_id_second")
+			Expect(err).Should(BeNil())
+
+			Expect(proxy.commands).Should(Equal([]string{
+				"validate " + firstDir, "start " + firstDir,
+				"validate " + secondDir, "reload " + secondDir,
+			}))
+
+			Expect(apiClient.deploymentResult.Status).Should(Equal(client.StatusSuccess))
+
+			status := manager.Status()
+			Expect(status.DeploymentID).Should(Equal("deployment_id_second"))
+			Expect(status.PreviousDeploymentID).Should(Equal("deployment_id_first"))
+			Expect(status.NginxRunning).Should(BeTrue())
+		})
+
+		It("should record when the proxy started serving a deployment", func() {
+			//the status nginx serves, as templating writes it
+			stagedDir := filepath.Join(tmpDir, "deployment_id_status")
+			Expect(os.Mkdir(stagedDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(stagedDir, "status.json"), []byte(`{"deploymentId": "deployment_id_status"}`), 0644)).To(Succeed())
+
+			stager.testConfigDir = stagedDir
+			apiClient.mockDeployment = &client.Deployment{ID: "deployment_id_status"}
+
+			before := time.Now().Add(-time.Second)
+
+			Expect(manager.ApplyDeployment(context.Background())).To(Succeed())
+
+			data, err := ioutil.ReadFile(filepath.Join(stagedDir, "status.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			status := make(map[string]string)
+			Expect(json.Unmarshal(data, &status)).To(Succeed())
+
+			appliedAt, err := time.Parse(time.RFC3339, status["appliedAt"])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(appliedAt).Should(BeTemporally(">=", before))
+			Expect(status["deploymentId"]).Should(Equal("deployment_id_status"))
+		})
+
+		It("should not record a deployment the proxy failed to reload as applied", func() {
+			_, err := apply("deployment_id_good")
+			Expect(err).Should(BeNil())
+
+			stagedDir := filepath.Join(tmpDir, "deployment_id_bad")
+			Expect(os.Mkdir(stagedDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(stagedDir, "status.json"), []byte(`{"deploymentId": "deployment_id_bad"}`), 0644)).To(Succeed())
+
+			//fail the rollback too, so the staged dir is kept
+			proxy.reloadErrs = map[string]error{stagedDir: errors.New("reload failed")}
+			proxy.reloadErrs[filepath.Join(tmpDir, "deployment_id_good")] = errors.New("rollback failed")
+
+			stager.testConfigDir = stagedDir
+			apiClient.mockDeployment = &client.Deployment{ID: "deployment_id_bad"}
+
+			Expect(manager.ApplyDeployment(context.Background())).ShouldNot(Succeed())
+
+			data, err := ioutil.ReadFile(filepath.Join(stagedDir, "status.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).ShouldNot(ContainSubstring("appliedAt"))
+		})
+
+		It("should not apply a config that fails validation", func() {
+			proxy.validateErr = &nginx.ConfigError{Output: "nginx: [emerg] unknown directive \"bogus\""}
+
+			stagedDir, err := apply("deployment_id_invalid")
+			Expect(err).ShouldNot(BeNil())
+
+			Expect(proxy.commands).Should(Equal([]string{"validate " + stagedDir}))
+			Expect(stagedDir).ShouldNot(BeADirectory())
+
+			Expect(apiClient.deploymentResult.Status).Should(Equal(client.StatusFail))
+			Expect(apiClient.deploymentResult.Error.ErrorCode).Should(Equal(client.ErrorCodeNginxConfigInvalid))
+		})
+
+		It("should roll back to the last deployment when a reload fails", func() {
+			goodDir, err := apply("deployment_id_good")
+			Expect(err).Should(BeNil())
+
+			proxy.reloadErrs = map[string]error{
+				filepath.Join(tmpDir, "deployment_id_bad"): errors.New("reload failed"),
+			}
+
+			badDir, err := apply("deployment_id_bad")
+			Expect(err).ShouldNot(BeNil())
+
+			//the bad deployment was reloaded, then the good one again
+			Expect(proxy.commands[len(proxy.commands)-2:]).Should(Equal([]string{"reload " + badDir, "reload " + goodDir}))
+
+			Expect(apiClient.deploymentResult.ID).Should(Equal("deployment_id_bad"))
+			Expect(apiClient.deploymentResult.Status).Should(Equal(client.StatusFail))
+			Expect(apiClient.deploymentResult.Error.ErrorCode).Should(Equal(client.ErrorCodeNginxReloadFailed))
+			Expect(apiClient.deploymentResult.Error.RolledBackTo).Should(Equal("deployment_id_good"))
+
+			status := manager.Status()
+			Expect(status.DeploymentID).Should(Equal("deployment_id_good"))
+			Expect(status.FailedDeploymentID).Should(Equal("deployment_id_bad"))
+
+			//nothing serves the bad deployment any more, the good one is still live
+			Expect(badDir).ShouldNot(BeAnExistingFile())
+			Expect(goodDir).Should(BeADirectory())
+		})
+
+		It("should roll back a deployment that fails the health check", func() {
+			goodDir, err := apply("deployment_id_good")
+			Expect(err).Should(BeNil())
+
+			manager.SetHealthChecker(&healthTester{
+				errs: map[string]error{"deployment_id_bad": errors.New("status does not report deployment_id_bad")},
+			})
+
+			badDir, err := apply("deployment_id_bad")
+			Expect(err).ShouldNot(BeNil())
+
+			//nginx accepted the bad deployment, then was put back on the good one
+			Expect(proxy.commands[len(proxy.commands)-2:]).Should(Equal([]string{"reload " + badDir, "reload " + goodDir}))
+
+			Expect(apiClient.deploymentResult.ID).Should(Equal("deployment_id_bad"))
+			Expect(apiClient.deploymentResult.Status).Should(Equal(client.StatusFail))
+			Expect(apiClient.deploymentResult.Error.ErrorCode).Should(Equal(client.ErrorCodeHealthCheckFailed))
+			Expect(apiClient.deploymentResult.Error.RolledBackTo).Should(Equal("deployment_id_good"))
+			Expect(apiClient.deploymentResult.Error.Reason).Should(ContainSubstring("status does not report deployment_id_bad"))
+
+			status := manager.Status()
+			Expect(status.DeploymentID).Should(Equal("deployment_id_good"))
+			Expect(status.FailedDeploymentID).Should(Equal("deployment_id_bad"))
+		})
+
+		It("should keep the failed deployment when the rollback fails too", func() {
+			goodDir, err := apply("deployment_id_good")
+			Expect(err).Should(BeNil())
+
+			proxy.reloadErrs = map[string]error{
+				filepath.Join(tmpDir, "deployment_id_bad"): errors.New("reload failed"),
+				goodDir: errors.New("rollback failed"),
+			}
+
+			badDir, err := apply("deployment_id_bad")
+			Expect(err).ShouldNot(BeNil())
+
+			Expect(proxy.commands[len(proxy.commands)-2:]).Should(Equal([]string{"reload " + badDir, "reload " + goodDir}))
+
+			Expect(apiClient.deploymentResult.Error.ErrorCode).Should(Equal(client.ErrorCodeNginxReloadFailed))
+			Expect(apiClient.deploymentResult.Error.RolledBackTo).Should(BeEmpty())
+			Expect(apiClient.deploymentResult.Error.Reason).Should(ContainSubstring("Rollback failed"))
+
+			//we can't tell what nginx is serving, so neither is removed
+			Expect(badDir).Should(BeADirectory())
+			Expect(goodDir).Should(BeADirectory())
+			Expect(manager.Status().DeploymentID).Should(Equal("deployment_id_good"))
+		})
+
+		It("should keep both deployments after rolling back a second failure", func() {
+			firstDir, err := apply("deployment_id_first")
+			Expect(err).Should(BeNil())
+
+			secondDir, err := apply("deployment_id_second")
+			Expect(err).Should(BeNil())
+
+			proxy.reloadErrs = map[string]error{
+				filepath.Join(tmpDir, "deployment_id_bad"): errors.New("reload failed"),
+			}
+
+			badDir, err := apply("deployment_id_bad")
+			Expect(err).ShouldNot(BeNil())
+
+			Expect(apiClient.deploymentResult.Error.RolledBackTo).Should(Equal("deployment_id_second"))
+
+			Expect(badDir).ShouldNot(BeAnExistingFile())
+			Expect(firstDir).Should(BeADirectory())
+			Expect(secondDir).Should(BeADirectory())
+
+			status := manager.Status()
+			Expect(status.DeploymentID).Should(Equal("deployment_id_second"))
+			Expect(status.PreviousDeploymentID).Should(Equal("deployment_id_first"))
+		})
+
+		It("should report a start timeout with nothing to roll back to", func() {
+			proxy.startErr = nginx.ErrStartTimeout
+
+			_, err := apply("deployment_id_slow")
+			Expect(err).ShouldNot(BeNil())
+
+			Expect(apiClient.deploymentResult.Error.ErrorCode).Should(Equal(client.ErrorCodeTimeout))
+			Expect(apiClient.deploymentResult.Error.RolledBackTo).Should(BeEmpty())
+			Expect(apiClient.deploymentResult.Error.Reason).Should(ContainSubstring("Rollback failed"))
+		})
+
+		It("should roll back and forward on request", func() {
+			firstDir, err := apply("deployment_id_first")
+			Expect(err).Should(BeNil())
+
+			secondDir, err := apply("deployment_id_second")
+			Expect(err).Should(BeNil())
+
+			Expect(manager.Rollback()).To(Succeed())
+			Expect(proxy.commands[len(proxy.commands)-1]).Should(Equal("reload " + firstDir))
+			Expect(manager.Status().DeploymentID).Should(Equal("deployment_id_first"))
+			Expect(manager.Status().Paused).Should(BeTrue())
+
+			Expect(manager.Rollback()).To(Succeed())
+			Expect(proxy.commands[len(proxy.commands)-1]).Should(Equal("reload " + secondDir))
+			Expect(manager.Status().DeploymentID).Should(Equal("deployment_id_second"))
+		})
+
+		It("should stop the proxy on shutdown if asked", func() {
+			_, err := apply("deployment_id_first")
+			Expect(err).Should(BeNil())
+
+			Expect(manager.Shutdown(false)).To(Succeed())
+			Expect(proxy.running).Should(BeTrue())
+
+			Expect(manager.Shutdown(true)).To(Succeed())
+			Expect(proxy.running).Should(BeFalse())
+			Expect(manager.Status().DeploymentID).Should(BeEmpty())
+		})
+
+		It("should shut down when the proxy is already stopped", func() {
+			stagedDir, err := apply("deployment_id_first")
+			Expect(err).Should(BeNil())
+
+			//exited on its own
+			proxy.running = false
+			proxy.stopErr = errors.New("nginx is not running")
+
+			Expect(manager.Shutdown(true)).To(Succeed())
+			Expect(proxy.commands).ShouldNot(ContainElement("stop"))
+			Expect(stagedDir).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should shut down when nginx exited and left its pid file", func() {
+			stagedDir, err := apply("deployment_id_first")
+			Expect(err).Should(BeNil())
+
+			//the pid of a process that has exited
+			cmd := exec.Command("true")
+			Expect(cmd.Run()).To(Succeed())
+
+			pidFile := filepath.Join(tmpDir, "nginx.pid")
+			Expect(ioutil.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)).To(Succeed())
+
+			manager.SetProxyController(nginx.NewNginxController(tmpDir, pidFile))
+
+			Expect(manager.Shutdown(true)).To(Succeed())
+			Expect(stagedDir).ShouldNot(BeAnExistingFile())
+		})
+	})
+
 	//TODO, test success, fail, success
 
 	It("Single Conflict Configuration", func() {
@@ -157,7 +621,7 @@ var _ = Describe("Manager", func() {
 
 		manager := nginx.NewManager(apiClient, stager, nginxDir, nginxPidFile, 1)
 
-		err = manager.ApplyDeployment()
+		err = manager.ApplyDeployment(context.Background())
 
 		//no error with valid bundle
 		Expect(err).ShouldNot(BeNil())
@@ -201,7 +665,7 @@ var _ = Describe("Manager", func() {
 
 		manager := nginx.NewManager(apiClient, stager, nginxDir, nginxPidFile, 1)
 
-		err = manager.ApplyDeployment()
+		err = manager.ApplyDeployment(context.Background())
 
 		//no error with valid bundle
 		Expect(err).ShouldNot(BeNil())
@@ -226,9 +690,19 @@ type stageTester struct {
 	testConfigDir string
 	//The error to set. If set it's returned.
 	err *client.DeploymentError
+	//onStage if set, called while staging
+	onStage func()
+	//stages the number of times Stage was called
+	stages int
 }
 
-func (test *stageTester) Stage(deployment *client.Deployment) (deploymentDir string, err *client.DeploymentError) {
+func (test *stageTester) Stage(ctx context.Context, deployment *client.Deployment) (deploymentDir string, err *client.DeploymentError) {
+	test.stages++
+
+	if test.onStage != nil {
+		test.onStage()
+	}
+
 	return test.testConfigDir, test.err
 }
 
@@ -238,13 +712,17 @@ type apiClientTester struct {
 
 	pollDeploymentsErr error
 
+	//polledETag the etag of the last poll
+	polledETag string
+
 	deploymentResult *client.DeploymentResult
 
 	deploymentResultErr error
 }
 
 //PollDeployments poll the deployments and return the deployment
-func (apiClient *apiClientTester) PollDeployments(etag string, timeout int) (*client.Deployment, error) {
+func (apiClient *apiClientTester) PollDeployments(ctx context.Context, etag string, timeout int) (*client.Deployment, error) {
+	apiClient.polledETag = etag
 	return apiClient.mockDeployment, apiClient.pollDeploymentsErr
 }
 
@@ -253,3 +731,62 @@ func (apiClient *apiClientTester) SetDeploymentResult(result *client.DeploymentR
 	apiClient.deploymentResult = result
 	return apiClient.deploymentResultErr
 }
+
+//healthTester a health checker that fails the deployments it has an error for
+type healthTester struct {
+	errs map[string]error
+}
+
+func (checker *healthTester) Check(deployment *client.Deployment) error {
+	return checker.errs[deployment.ID]
+}
+
+//proxyTester a proxy that records what it was asked to do instead of running anything
+type proxyTester struct {
+	running bool
+
+	validateErr error
+	startErr    error
+	stopErr     error
+	//reloadErrs the error reloading each staged dir
+	reloadErrs map[string]error
+
+	//commands what the proxy was asked to do, in order
+	commands []string
+}
+
+func (proxy *proxyTester) Validate(ctx context.Context, stagedDir string) error {
+	proxy.commands = append(proxy.commands, "validate "+stagedDir)
+	return proxy.validateErr
+}
+
+func (proxy *proxyTester) Start(ctx context.Context, stagedDir string) error {
+	proxy.commands = append(proxy.commands, "start "+stagedDir)
+
+	if proxy.startErr != nil {
+		return proxy.startErr
+	}
+
+	proxy.running = true
+	return nil
+}
+
+func (proxy *proxyTester) Reload(ctx context.Context, stagedDir string) error {
+	proxy.commands = append(proxy.commands, "reload "+stagedDir)
+	return proxy.reloadErrs[stagedDir]
+}
+
+func (proxy *proxyTester) Stop() error {
+	proxy.commands = append(proxy.commands, "stop")
+
+	if proxy.stopErr != nil {
+		return proxy.stopErr
+	}
+
+	proxy.running = false
+	return nil
+}
+
+func (proxy *proxyTester) Status() (bool, error) {
+	return proxy.running, nil
+}
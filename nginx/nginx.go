@@ -2,60 +2,120 @@ package nginx
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
+	"path"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 )
 
-//TestConfig Test the configuration of the nginx file.  Will return an error if an error or warning is detected
-func TestConfig(prefixPath, configFile string) error {
-	cmd := exec.Command("nginx", "-t", "-p", prefixPath, "-c", configFile)
+//ErrStartTimeout the Err of a StartError when nginx didn't start within the start timeout
+var ErrStartTimeout = errors.New("Process timed out waiting for nginx to start")
 
-	// log.Printf("About to execute command %+v", cmd)
+//defaultBinaryPath the nginx binary when none is configured, found on the PATH
+const defaultBinaryPath = "nginx"
 
-	out, execErr := cmd.CombinedOutput()
+//DefaultBinary nginx from the PATH, with no extra globals or environment.  Used by the package level functions
+var DefaultBinary = &Binary{}
 
-	err := findError("emerg", out)
-	if err != nil {
-		return err
+//Binary an nginx executable and how every nginx subprocess is run
+type Binary struct {
+	//Path the nginx executable.  Defaults to nginx on the PATH
+	Path string
+	//Globals extra global directives passed to every command with -g, e.g. "worker_processes 2;"
+	Globals string
+	//Env extra KEY=VALUE environment for nginx, on top of our own environment
+	Env []string
+}
+
+//FindBinaryPath the nginx executable installed in the prefix path, sbin/nginx, if there is one.  Otherwise nginx on the PATH
+func FindBinaryPath(prefixPath string) string {
+	if prefixPath != "" {
+		binaryPath := path.Join(prefixPath, "sbin", "nginx")
+
+		if fileInfo, err := os.Stat(binaryPath); err == nil && !fileInfo.IsDir() {
+			return binaryPath
+		}
 	}
 
-	err = findError("warn", out)
-	if err != nil {
-		return err
+	return defaultBinaryPath
+}
+
+//TestConfig Test the configuration of the nginx file with nginx on the PATH.  See Binary.TestConfig
+func TestConfig(ctx context.Context, prefixPath, configFile string) error {
+	return DefaultBinary.TestConfig(ctx, prefixPath, configFile)
+}
+
+//Start Start nginx on the PATH.  See Binary.Start
+func Start(ctx context.Context, prefixPath, configFilePath string, startTimeout time.Duration) error {
+	return DefaultBinary.Start(ctx, prefixPath, configFilePath, startTimeout)
+}
+
+//Stop Stop nginx on the PATH.  See Binary.Stop
+func Stop(prefixPath string) error {
+	return DefaultBinary.Stop(prefixPath)
+}
+
+//Reload Reload nginx on the PATH.  See Binary.Reload
+func Reload(ctx context.Context, prefixPath, configFilePath string) error {
+	return DefaultBinary.Reload(ctx, prefixPath, configFilePath)
+}
+
+//command an nginx command with the globals and environment.  The command is killed if ctx is cancelled
+func (binary *Binary) command(ctx context.Context, args ...string) *exec.Cmd {
+	binaryPath := binary.Path
+
+	if binaryPath == "" {
+		binaryPath = defaultBinaryPath
 	}
 
-	//defer checking the execErr until the end.  Otherwise we won't receive emerg errors
-	if execErr != nil {
-		return execErr
+	if binary.Globals != "" {
+		args = append(args, "-g", binary.Globals)
 	}
 
-	return nil
+	cmd := exec.CommandContext(ctx, binaryPath, args...)
+
+	if len(binary.Env) > 0 {
+		cmd.Env = append(os.Environ(), binary.Env...)
+	}
+
+	return cmd
 }
 
-func findError(errType string, message []byte) error {
-	matched, err := regexp.Match("^nginx: \\["+errType+"\\]", message)
-	if err != nil {
-		return err
+//TestConfig Test the configuration of the nginx file.  Will return an error if an error or warning is detected.  The test is killed if ctx is cancelled
+func (binary *Binary) TestConfig(ctx context.Context, prefixPath, configFile string) error {
+	cmd := binary.command(ctx, "-t", "-p", prefixPath, "-c", configFile)
+
+	// log.Printf("About to execute command %+v", cmd)
+
+	out, execErr := cmd.CombinedOutput()
+
+	//any error or warning fails the config
+	configErr := ParseConfigError(out)
+	if configErr != nil {
+		return configErr
 	}
-	if matched {
-		return fmt.Errorf("Config error:\n%s", message)
+
+	//defer checking the execErr until the end.  Otherwise we won't receive emerg errors
+	if execErr != nil {
+		return execErr
 	}
+
 	return nil
 }
 
-//Start Start the nginx process with the prefix path, the config file path, and the start timeout.  If the start timeout elapses, a timeoutError will be thrown
-func Start(prefixPath, configFilePath string, startTimeout time.Duration) error {
+//Start Start the nginx process with the prefix path, the config file path, and the start timeout.  If the start timeout elapses, a timeoutError will be thrown.
+//The start is killed if ctx is cancelled
+func (binary *Binary) Start(ctx context.Context, prefixPath, configFilePath string, startTimeout time.Duration) error {
 
-	command := exec.Command("nginx", "-p", prefixPath, "-c", configFilePath)
+	command := binary.command(ctx, "-p", prefixPath, "-c", configFilePath)
 
 	log.Printf("About to start nginx with command %+v", command)
 
@@ -85,10 +145,10 @@ func Start(prefixPath, configFilePath string, startTimeout time.Duration) error
 		log.Printf("Timeout occured when waiting for nginx start to exist after %s.  Pid is %d", startTimeout, command.ProcessState.Pid())
 		//try to kill the nginx process from pid here, see what happens
 
-		timeoutErr = errors.New("Process timed out waiting for nginx to start")
+		timeoutErr = ErrStartTimeout
 
 		//we have to stop in this timeout block. If we don't, we can't seem to stop nginx after we kill the start process
-		err := Stop(prefixPath)
+		err := binary.Stop(prefixPath)
 
 		if err != nil {
 			log.Printf("WARNING: Unable to stop NGINX after timeout.  Process may still be running in an unknown state. Error is %s", err)
@@ -124,7 +184,7 @@ func Start(prefixPath, configFilePath string, startTimeout time.Duration) error
 
 		//if we didn't timeout we haven't stopped already, try to stop the process
 
-		stopErr := Stop(prefixPath)
+		stopErr := binary.Stop(prefixPath)
 
 		if stopErr != nil {
 			log.Printf("WARNING: Unable to stop NGINX after errors reported in stdErr.  Process may still be running in an unknown state. Error is %s", stopErr)
@@ -145,16 +205,18 @@ func Start(prefixPath, configFilePath string, startTimeout time.Duration) error
 	return nil
 }
 
-func Stop(prefixPath string) error {
-	out, err := exec.Command("nginx", "-p", prefixPath, "-s", "stop").CombinedOutput()
+//Stop signal the running nginx to stop
+func (binary *Binary) Stop(prefixPath string) error {
+	out, err := binary.command(context.Background(), "-p", prefixPath, "-s", "stop").CombinedOutput()
 	if err != nil {
 		return fmt.Errorf(string(out))
 	}
 	return nil
 }
 
-func Reload(prefixPath, configFilePath string) error {
-	out, err := exec.Command("nginx", "-p", prefixPath, "-c", configFilePath, "-s", "reload").CombinedOutput()
+//Reload signal the running nginx to reload with the config file.  The reload is killed if ctx is cancelled
+func (binary *Binary) Reload(ctx context.Context, prefixPath, configFilePath string) error {
+	out, err := binary.command(ctx, "-p", prefixPath, "-c", configFilePath, "-s", "reload").CombinedOutput()
 	if err != nil {
 		return fmt.Errorf(string(out))
 	}
@@ -184,6 +246,11 @@ func IsRunning(pidFile string) (bool, error) {
 
 	err = process.Signal(syscall.Signal(0))
 
+	//the pid file outlived nginx, e.g. it was killed
+	if processFinished(err) {
+		return false, nil
+	}
+
 	if err != nil {
 		return false, err
 	}
@@ -192,6 +259,16 @@ func IsRunning(pidFile string) (bool, error) {
 
 }
 
+//processFinished true if err from signalling a process means it no longer exists
+func processFinished(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	//os reports a process the kernel doesn't know as finished, rather than with ESRCH
+	return err == syscall.ESRCH || err.Error() == "os: process already finished"
+}
+
 //killProcess kill the process in the pid file if it exists
 func killProcess(pidFile string) error {
 	pid, err := getNginxPid(pidFile)
@@ -223,7 +300,7 @@ func getNginxPid(pidFile string) (int, error) {
 
 	if err != nil {
 		//if it's a not exist error, we swallow it, since it won't be running
-		if err != os.ErrNotExist {
+		if !os.IsNotExist(err) {
 			return 0, err
 		}
 
@@ -1,10 +1,15 @@
 package nginx_test
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/30x/keymaster/nginx"
@@ -32,7 +37,7 @@ var _ = Describe("nginx", func() {
 			Expect(err).NotTo(HaveOccurred())
 			defer os.RemoveAll(path.Dir(tmpfile.Name()))
 
-			err = nginx.TestConfig(testdir, tmpfile.Name())
+			err = nginx.TestConfig(context.Background(), testdir, tmpfile.Name())
 			Expect(err).NotTo(HaveOccurred())
 		})
 
@@ -41,7 +46,7 @@ var _ = Describe("nginx", func() {
 			Expect(err).NotTo(HaveOccurred())
 			defer os.RemoveAll(path.Dir(tmpfile.Name()))
 
-			err = nginx.TestConfig(testdir, tmpfile.Name())
+			err = nginx.TestConfig(context.Background(), testdir, tmpfile.Name())
 			Expect(err).To(HaveOccurred())
 		})
 
@@ -50,7 +55,7 @@ var _ = Describe("nginx", func() {
 			Expect(err).NotTo(HaveOccurred())
 			defer os.RemoveAll(path.Dir(tmpfile.Name()))
 
-			err = nginx.TestConfig(testdir, tmpfile.Name())
+			err = nginx.TestConfig(context.Background(), testdir, tmpfile.Name())
 			Expect(err).To(HaveOccurred())
 		})
 	})
@@ -63,7 +68,7 @@ var _ = Describe("nginx", func() {
 			tmpDir := path.Dir(tmpFile.Name())
 			defer os.RemoveAll(tmpDir)
 
-			err = nginx.Start(tmpDir, tmpFile.Name(), 10*time.Second)
+			err = nginx.Start(context.Background(), tmpDir, tmpFile.Name(), 10*time.Second)
 			Expect(err).NotTo(HaveOccurred())
 			defer nginx.Stop(tmpDir)
 
@@ -80,7 +85,7 @@ var _ = Describe("nginx", func() {
 			tmpDir := path.Dir(tmpFile.Name())
 			defer os.RemoveAll(tmpDir)
 
-			err = nginx.Start(tmpDir, tmpFile.Name(), 10*time.Second)
+			err = nginx.Start(context.Background(), tmpDir, tmpFile.Name(), 10*time.Second)
 			Expect(err).NotTo(HaveOccurred())
 			defer nginx.Stop(tmpDir)
 
@@ -91,7 +96,7 @@ var _ = Describe("nginx", func() {
 
 			err = ioutil.WriteFile(tmpFile.Name(), []byte(upgraded_conf), 0644)
 			Expect(err).NotTo(HaveOccurred())
-			err = nginx.Reload(tmpDir, tmpFile.Name())
+			err = nginx.Reload(context.Background(), tmpDir, tmpFile.Name())
 			Expect(err).NotTo(HaveOccurred())
 			time.Sleep(150 * time.Millisecond) // give it a moment to reload
 
@@ -107,7 +112,7 @@ var _ = Describe("nginx", func() {
 			tmpDir := path.Dir(tmpFile.Name())
 			defer os.RemoveAll(tmpDir)
 
-			err = nginx.Start(tmpDir, tmpFile.Name(), 10*time.Second)
+			err = nginx.Start(context.Background(), tmpDir, tmpFile.Name(), 10*time.Second)
 			Expect(err).NotTo(HaveOccurred())
 			defer nginx.Stop(tmpDir)
 
@@ -118,7 +123,7 @@ var _ = Describe("nginx", func() {
 
 			err = ioutil.WriteFile(tmpFile.Name(), []byte(invalid_conf), 0644)
 			Expect(err).NotTo(HaveOccurred())
-			err = nginx.Reload(tmpDir, tmpFile.Name())
+			err = nginx.Reload(context.Background(), tmpDir, tmpFile.Name())
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(Equal("nginx: [emerg] no \"events\" section in configuration\n"))
 
@@ -129,6 +134,139 @@ var _ = Describe("nginx", func() {
 			Expect(string(body)).To(Equal("Hello, world\n"))
 		})
 	})
+
+	Describe("Binary", func() {
+
+		var tmpDir string
+		var binary *nginx.Binary
+
+		//stub write a stub nginx that records its arguments and environment, prints the output and exits with the code
+		stub := func(output string, exitCode int) string {
+			stubPath := path.Join(tmpDir, "sbin", "nginx")
+
+			script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s/args\necho \"$KEYMASTER_STUB\" >> %s/env\nprintf '%%s' '%s' >&2\nexit %d\n", tmpDir, tmpDir, output, exitCode)
+
+			Expect(os.MkdirAll(path.Dir(stubPath), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(stubPath, []byte(script), 0755)).To(Succeed())
+
+			return stubPath
+		}
+
+		//recorded the lines the stub recorded in the file
+		recorded := func(file string) []string {
+			data, err := ioutil.ReadFile(path.Join(tmpDir, file))
+			Expect(err).NotTo(HaveOccurred())
+
+			return strings.Split(strings.TrimSpace(string(data)), "\n")
+		}
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = util.MkTempDir("", "binary", 0755)
+			Expect(err).NotTo(HaveOccurred())
+
+			binary = &nginx.Binary{
+				Globals: "worker_processes 2;",
+				Env:     []string{"KEYMASTER_STUB=stubbed"},
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("should run the configured binary with the globals and environment", func() {
+			binary.Path = stub("", 0)
+
+			Expect(binary.TestConfig(context.Background(), tmpDir, "nginx.conf")).To(Succeed())
+			Expect(binary.Start(context.Background(), tmpDir, "nginx.conf", 10*time.Second)).To(Succeed())
+			Expect(binary.Reload(context.Background(), tmpDir, "nginx.conf")).To(Succeed())
+			Expect(binary.Stop(tmpDir)).To(Succeed())
+
+			Expect(recorded("args")).Should(Equal([]string{
+				"-t -p " + tmpDir + " -c nginx.conf -g worker_processes 2;",
+				"-p " + tmpDir + " -c nginx.conf -g worker_processes 2;",
+				"-p " + tmpDir + " -c nginx.conf -s reload -g worker_processes 2;",
+				"-p " + tmpDir + " -s stop -g worker_processes 2;",
+			}))
+
+			Expect(recorded("env")).Should(Equal([]string{"stubbed", "stubbed", "stubbed", "stubbed"}))
+		})
+
+		It("should report config errors from the binary", func() {
+			binary.Path = stub("nginx: [emerg] unknown directive \"bogus\" in /tmp/nginx.conf:3", 1)
+
+			err := binary.TestConfig(context.Background(), tmpDir, "nginx.conf")
+			Expect(err).To(HaveOccurred())
+
+			configErr, ok := err.(*nginx.ConfigError)
+			Expect(ok).Should(BeTrue())
+			Expect(configErr.Messages).Should(HaveLen(1))
+			Expect(configErr.Messages[0].Line).Should(Equal(3))
+		})
+
+		It("should fail to start when the binary fails", func() {
+			binary.Path = stub("nginx: [emerg] bind() failed", 1)
+
+			err := binary.Start(context.Background(), tmpDir, "nginx.conf", 10*time.Second)
+			Expect(err).To(HaveOccurred())
+
+			startErr, ok := err.(*nginx.StartError)
+			Expect(ok).Should(BeTrue())
+			Expect(startErr.StdErr).Should(ContainSubstring("bind() failed"))
+		})
+
+		It("should return the output of a failed reload", func() {
+			binary.Path = stub("nginx: [error] invalid PID number", 1)
+
+			err := binary.Reload(context.Background(), tmpDir, "nginx.conf")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(Equal("nginx: [error] invalid PID number"))
+		})
+
+		It("should find the binary in the prefix path", func() {
+			Expect(nginx.FindBinaryPath(tmpDir)).Should(Equal("nginx"))
+
+			stubPath := stub("", 0)
+
+			Expect(nginx.FindBinaryPath(tmpDir)).Should(Equal(stubPath))
+			Expect(nginx.FindBinaryPath("")).Should(Equal("nginx"))
+		})
+	})
+
+	Describe("IsRunning", func() {
+
+		var pidFile string
+
+		BeforeEach(func() {
+			tmpFile, err := ioutil.TempFile("", "nginx.pid")
+			Expect(err).NotTo(HaveOccurred())
+			tmpFile.Close()
+
+			pidFile = tmpFile.Name()
+		})
+
+		AfterEach(func() {
+			os.Remove(pidFile)
+		})
+
+		It("should be running when the process in the pid file is", func() {
+			Expect(ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644)).To(Succeed())
+
+			Expect(nginx.IsRunning(pidFile)).Should(BeTrue())
+		})
+
+		It("should not be running when the process in the pid file has exited", func() {
+			cmd := exec.Command("true")
+			Expect(cmd.Run()).To(Succeed())
+
+			Expect(ioutil.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)).To(Succeed())
+
+			running, err := nginx.IsRunning(pidFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(running).Should(BeFalse())
+		})
+	})
 })
 
 func writeConf(content string) (*os.File, error) {
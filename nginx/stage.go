@@ -1,88 +1,300 @@
 package nginx
 
 import (
+	"archive/zip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"time"
 
 	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/metrics"
 	"github.com/30x/keymaster/util"
 )
 
+//DefaultBundleCacheDir the directory remote bundles are downloaded to when none is configured
+var DefaultBundleCacheDir = path.Join(os.TempDir(), "keymaster-bundles")
+
+//ErrStageCancelled the reason staging failed when it was cancelled
+var ErrStageCancelled = errors.New("Staging was cancelled")
+
+//downloadClient the client used to fetch http(s) bundles.  Don't wait forever on a single bundle
+var downloadClient = &http.Client{Timeout: 5 * time.Minute}
+
 //StageManager the manager for staging a deployment
 type StageManager interface {
-	Stage(deployment *client.Deployment) (deploymentDir string, err *client.DeploymentError)
+	Stage(ctx context.Context, deployment *client.Deployment) (deploymentDir string, err *client.DeploymentError)
 }
 
-//StageManagerImpl impl placeholder impelemntation
+//StageManagerImpl stages deployments from local or remote bundles.  The zero value is ready to use
 type StageManagerImpl struct {
-}
+	//BundleCacheDir the directory http(s) bundles are downloaded to.  Defaults to DefaultBundleCacheDir
+	BundleCacheDir string
+
+	//Cache if set, unzipped bundles are reused across deployments instead of being unzipped every time
+	Cache *BundleCache
+
+	//UnzipLimits the limits bundle archives must be within.  Defaults to util.DefaultUnzipLimits
+	UnzipLimits *util.UnzipLimits
 
-//Stage stage the manager
-func (stageManager *StageManagerImpl) Stage(deployment *client.Deployment) (deploymentDir string, err *client.DeploymentError) {
-	return Stage(deployment)
+	//TrustedKeys if set, every bundle must carry a signature from one of these keys
+	TrustedKeys []crypto.PublicKey
 }
 
-// Stage unzip, process templates, and validate the deployment.
+// Stage unzip, validate, and process templates for the deployment using the default StageManagerImpl.
 // returns directory, DeploymentError
 // if directory returned is not empty (may be non-empty even if error), client is responsible for cleanup
-func Stage(deployment *client.Deployment) (string, *client.DeploymentError) {
+func Stage(ctx context.Context, deployment *client.Deployment) (string, *client.DeploymentError) {
+	return new(StageManagerImpl).Stage(ctx, deployment)
+}
+
+// Stage unzip, validate, and process templates for the deployment.
+// returns directory, DeploymentError
+// if directory returned is not empty (may be non-empty even if error), client is responsible for cleanup.
+// If ctx is cancelled staging is abandoned, the directory is removed and ErrStageCancelled is the reason
+func (stageManager *StageManagerImpl) Stage(ctx context.Context, deployment *client.Deployment) (string, *client.DeploymentError) {
+
+	if stageManager.Cache != nil {
+		//anything we use in this deployment is newer than this, so it can't be evicted
+		stageStart := time.Now()
+
+		defer func() {
+			err := stageManager.Cache.Evict(stageStart)
+
+			//swallow this error, the deployment is still good
+			if err != nil {
+				log.Printf("Unable to evict bundles from the cache.  Error is %s", err)
+			}
+		}()
+	}
 
 	deploymentDir, err := util.MkTempDir("", deployment.ID, 0755)
 	if err != nil {
-		return "", &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+		return "", &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
+	}
+
+	systemZip, bundleZips, deploymentError := stageManager.fetchBundles(ctx, deployment)
+	if ctx.Err() != nil {
+		return "", stageCancelled(deploymentDir)
 	}
 
-	deploymentError := unzipSystem(deploymentDir, deployment)
 	if deploymentError != nil {
 		return deploymentDir, deploymentError
 	}
 
-	deploymentError = unzipDeploymentBundles(deploymentDir, deployment)
+	deploymentError = stageManager.unzipSystem(deploymentDir, deployment, systemZip)
 	if deploymentError != nil {
 		return deploymentDir, deploymentError
 	}
 
-	deploymentError = Template(deploymentDir, deployment)
+	deploymentError = stageManager.unzipDeploymentBundles(deploymentDir, deployment, bundleZips)
 	if deploymentError != nil {
 		return deploymentDir, deploymentError
 	}
 
-	// todo
-	//deploymentError = ValidateDeployment(deploymentDir, deployment)
-	//if deploymentError != nil {
-	//	return deploymentDir, deploymentError
-	//}
+	if ctx.Err() != nil {
+		return "", stageCancelled(deploymentDir)
+	}
+
+	deploymentError = ValidateDeployment(deploymentDir, deployment)
+	if deploymentError != nil {
+		return deploymentDir, deploymentError
+	}
+
+	templateStart := time.Now()
+	deploymentError = Template(deploymentDir, deployment)
+	metrics.TemplateDuration.Observe(metrics.Since(templateStart))
+	if deploymentError != nil {
+		return deploymentDir, deploymentError
+	}
 
 	return deploymentDir, deploymentError
 }
 
+//stageCancelled remove the partially staged deployment after staging was cancelled
+func stageCancelled(deploymentDir string) *client.DeploymentError {
+	err := os.RemoveAll(deploymentDir)
+
+	//swallow this error, we're stopping anyway
+	if err != nil {
+		log.Printf("Unable to remove directory %s.  Error is %s", deploymentDir, err)
+	}
+
+	return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: ErrStageCancelled.Error()}
+}
+
+//fetchBundles get a local zip for the system and every deployment bundle and verify their integrity before anything is unzipped.
+//Returns the system zip, and the zip for each deployment bundle in order.  Every bundle that fails is reported in the BundleErrors
+func (stageManager *StageManagerImpl) fetchBundles(ctx context.Context, deployment *client.Deployment) (string, []string, *client.DeploymentError) {
+	bundleErrors := []client.BundleError{}
+
+	fetch := func(bundleID, bundleURL, filePath, authCode, checksum, signature string) string {
+		zipFile, downloaded, err := stageManager.fetchBundle(ctx, bundleID, bundleURL, filePath, authCode, checksum)
+		if err != nil {
+			bundleErrors = append(bundleErrors, client.BundleError{BundleID: bundleID, ErrorCode: client.ErrorCodeDownloadFailed, Reason: err.Error()})
+			return zipFile
+		}
+
+		err = stageManager.verify(zipFile, checksum, signature)
+		if err != nil {
+			bundleErrors = append(bundleErrors, client.BundleError{BundleID: bundleID, ErrorCode: client.ErrorCodeVerificationFailed, Reason: err.Error()})
+
+			//don't keep a bad download, the next deployment fetches it again
+			if downloaded {
+				os.Remove(zipFile)
+			}
+		}
+
+		return zipFile
+	}
+
+	system := deployment.System
+	systemZip := fetch(system.BundleID, system.URL, system.FilePath(), "", system.Checksum, system.Signature)
+
+	bundleZips := make([]string, len(deployment.Bundles))
+
+	for i, bundle := range deployment.Bundles {
+		bundleZips[i] = fetch(bundle.BundleID, bundle.URL, bundle.FilePath(), bundle.AuthCode, bundle.Checksum, bundle.Signature)
+	}
+
+	if len(bundleErrors) > 0 {
+		return "", nil, &client.DeploymentError{
+			ErrorCode:    bundleErrors[0].ErrorCode,
+			Reason:       fmt.Sprintf("Unable to fetch %d bundle(s).  First error is %s", len(bundleErrors), bundleErrors[0].Reason),
+			BundleErrors: bundleErrors,
+		}
+	}
+
+	return systemZip, bundleZips, nil
+}
+
+//verify check the zip against its checksum and signature.  If we have trusted keys every bundle must be signed by one of them
+func (stageManager *StageManagerImpl) verify(zipFile, checksum, signature string) error {
+	if len(stageManager.TrustedKeys) > 0 && signature == "" {
+		return fmt.Errorf("Bundle %s is not signed", zipFile)
+	}
+
+	err := util.VerifyFile(zipFile, checksum, signature, stageManager.TrustedKeys)
+	if err != nil {
+		return fmt.Errorf("Bundle %s failed verification.  %s", zipFile, err)
+	}
+
+	return nil
+}
+
 // todo: may want to reconsider putting system at top level - possible name conflicts w/ deployment bundles?
-func unzipSystem(deploymentDir string, deployment *client.Deployment) *client.DeploymentError {
+func (stageManager *StageManagerImpl) unzipSystem(deploymentDir string, deployment *client.Deployment, zipFile string) *client.DeploymentError {
 
-	err := util.Unzip(deployment.System.FilePath(), deploymentDir)
+	err := stageManager.extract(deployment.System.BundleID, zipFile, deploymentDir)
 	if err != nil {
-		return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeUnzipFailed, Reason: err.Error()}
 	}
 
 	return nil
 }
 
 // unzipBundles unzip the deployment and return the directory
-func unzipDeploymentBundles(deploymentDir string, deployment *client.Deployment) *client.DeploymentError {
+func (stageManager *StageManagerImpl) unzipDeploymentBundles(deploymentDir string, deployment *client.Deployment, zipFiles []string) *client.DeploymentError {
 
-	for _, bundle := range deployment.Bundles {
+	for i, bundle := range deployment.Bundles {
 
 		bundleDir := path.Join(deploymentDir, bundle.BundleID)
 		err := os.Mkdir(bundleDir, 0755)
 		if err != nil {
-			return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+			return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
 		}
 
-		err = util.Unzip(bundle.FilePath(), bundleDir)
+		err = stageManager.extract(bundle.BundleID, zipFiles[i], bundleDir)
 		if err != nil {
-			return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+			return &client.DeploymentError{
+				ErrorCode: client.ErrorCodeUnzipFailed,
+				Reason:    err.Error(),
+				BundleErrors: []client.BundleError{
+					{BundleID: bundle.BundleID, ErrorCode: client.ErrorCodeUnzipFailed, Reason: err.Error()},
+				},
+			}
 		}
 	}
 
 	return nil
 }
+
+//extract populate destDir with the contents of the bundle zip, from the cache if we have one
+func (stageManager *StageManagerImpl) extract(bundleID, zipFile, destDir string) error {
+	limits := util.DefaultUnzipLimits
+	if stageManager.UnzipLimits != nil {
+		limits = *stageManager.UnzipLimits
+	}
+
+	if stageManager.Cache != nil {
+		return stageManager.Cache.Link(bundleID, zipFile, destDir, limits)
+	}
+
+	return util.UnzipWithLimits(zipFile, destDir, limits)
+}
+
+//fetchBundle return the path of a local zip for the bundle url, and whether it's a download in the bundle cache dir.
+//http(s) urls are downloaded to the bundle cache dir, using the authCode as the credential.  Any other url is already local, and filePath is returned.
+//Downloads are keyed by the url and checksum, so a bundle with a new url or checksum is fetched again.  A cached download that's no longer a readable zip is fetched again
+func (stageManager *StageManagerImpl) fetchBundle(ctx context.Context, bundleID, bundleURL, filePath, authCode, checksum string) (string, bool, error) {
+	parsedURL, err := url.Parse(bundleURL)
+	if err != nil {
+		return "", false, err
+	}
+
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return filePath, false, nil
+	}
+
+	cacheDir := stageManager.BundleCacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultBundleCacheDir
+	}
+
+	zipFile := path.Join(cacheDir, downloadFileName(bundleID, bundleURL, checksum))
+
+	if _, err := os.Stat(zipFile); err == nil {
+		if isReadableZip(zipFile) {
+			//keep it from being evicted from the cache
+			now := time.Now()
+			return zipFile, true, os.Chtimes(zipFile, now, now)
+		}
+
+		log.Printf("Cached bundle %s is corrupt, downloading it again", zipFile)
+		os.Remove(zipFile)
+	}
+
+	err = util.Download(ctx, downloadClient, bundleURL, authCode, zipFile)
+	if err != nil {
+		return "", false, err
+	}
+
+	return zipFile, true, nil
+}
+
+//downloadFileName the file a bundle is downloaded to in the cache dir.  Keyed by the url and checksum as well as the id, since the same bundle id may be served with new content
+func downloadFileName(bundleID, bundleURL, checksum string) string {
+	key := sha256.Sum256([]byte(bundleURL + "\n" + checksum))
+
+	return bundleFileName(bundleID) + "-" + hex.EncodeToString(key[:8]) + ".zip"
+}
+
+//isReadableZip true if the file's zip directory can be read.  A truncated download can't be
+func isReadableZip(zipFile string) bool {
+	reader, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return false
+	}
+
+	reader.Close()
+
+	return true
+}
@@ -1,11 +1,19 @@
 package nginx_test
 
 import (
+	"context"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/30x/keymaster/nginx"
 	"path"
+	"path/filepath"
 	"github.com/30x/keymaster/client"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 )
 
@@ -24,6 +32,7 @@ var _ = Describe("stage", func() {
 			bundles[0] = &client.DeploymentBundle{
 				BundleID: "bundle1",
 				URL: "file://../test/testbundle.zip",
+				Target: "http://localhost",
 			}
 
 			deployment := &client.Deployment{
@@ -32,7 +41,7 @@ var _ = Describe("stage", func() {
 				Bundles: bundles,
 			}
 
-			stageDir, err := nginx.Stage(deployment)
+			stageDir, err := nginx.Stage(context.Background(), deployment)
 			if stageDir != "" {
 				defer os.RemoveAll(stageDir)
 			}
@@ -55,6 +64,290 @@ var _ = Describe("stage", func() {
 			pipeFile = path.Join(bundleDir, "pipes", "dump.yaml")
 			Expect(pipeFile).Should(BeAnExistingFile())
 		})
+
+		It("should download http bundles", func() {
+
+			authHeaders := make(map[string]string)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authHeaders[r.URL.Path] = r.Header.Get("Authorization")
+				http.ServeFile(w, r, path.Join("../test", path.Base(r.URL.Path)))
+			}))
+			defer server.Close()
+
+			cacheDir, err := ioutil.TempDir("", "bundleCache")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(cacheDir)
+
+			systemBundle := &client.SystemBundle{
+				BundleID: "system1",
+				URL: server.URL + "/testsystem.zip",
+			}
+
+			bundles := make([]*client.DeploymentBundle, 1)
+			bundles[0] = &client.DeploymentBundle{
+				BundleID: "bundle1",
+				AuthCode: "secret",
+				URL: server.URL + "/testbundle.zip",
+				Target: "http://localhost",
+			}
+
+			deployment := &client.Deployment{
+				ID: "deployment_id",
+				System: systemBundle,
+				Bundles: bundles,
+			}
+
+			stageManager := &nginx.StageManagerImpl{
+				BundleCacheDir: cacheDir,
+			}
+
+			stageDir, deploymentErr := stageManager.Stage(context.Background(), deployment)
+			if stageDir != "" {
+				defer os.RemoveAll(stageDir)
+			}
+			Expect(deploymentErr).To(BeNil())
+
+			Expect(path.Join(stageDir, "nginx.conf")).Should(BeAnExistingFile())
+			Expect(path.Join(stageDir, "bundle1", "bundle.yaml")).Should(BeAnExistingFile())
+			Expect(path.Join(stageDir, "bundle1", "pipes", "apikey.yaml")).Should(BeAnExistingFile())
+
+			//the auth code is our credential
+			Expect(authHeaders["/testbundle.zip"]).Should(Equal("Bearer secret"))
+			Expect(authHeaders["/testsystem.zip"]).Should(BeEmpty())
+
+			//downloads are left in the cache
+			Expect(filepath.Glob(path.Join(cacheDir, "bundle1-*.zip"))).Should(HaveLen(1))
+			Expect(filepath.Glob(path.Join(cacheDir, "system1-*.zip"))).Should(HaveLen(1))
+		})
+
+		Describe("download cache", func() {
+
+			var server *httptest.Server
+			var cacheDir string
+			var requests map[string]int
+
+			BeforeEach(func() {
+				requests = make(map[string]int)
+
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requests[r.URL.Path]++
+					http.ServeFile(w, r, path.Join("../test", path.Base(r.URL.Path)))
+				}))
+
+				var err error
+				cacheDir, err = ioutil.TempDir("", "bundleCache")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				server.Close()
+				os.RemoveAll(cacheDir)
+			})
+
+			//stage a deployment with only a system bundle from the url
+			stage := func(systemURL, checksum string) *client.DeploymentError {
+				deployment := &client.Deployment{
+					ID: "deployment_id",
+					System: &client.SystemBundle{
+						BundleID: "system1",
+						URL: systemURL,
+						Checksum: checksum,
+					},
+				}
+
+				stageManager := &nginx.StageManagerImpl{
+					BundleCacheDir: cacheDir,
+				}
+
+				stageDir, deploymentErr := stageManager.Stage(context.Background(), deployment)
+				if stageDir != "" {
+					os.RemoveAll(stageDir)
+				}
+
+				return deploymentErr
+			}
+
+			It("should reuse a download for the same url", func() {
+				Expect(stage(server.URL+"/testsystem.zip", "")).To(BeNil())
+				Expect(stage(server.URL+"/testsystem.zip", "")).To(BeNil())
+
+				Expect(requests["/testsystem.zip"]).Should(Equal(1))
+			})
+
+			It("should download a bundle again when its url changes", func() {
+				Expect(stage(server.URL+"/testsystem.zip", "")).To(BeNil())
+				Expect(stage(server.URL+"/v2/testsystem.zip", "")).To(BeNil())
+
+				Expect(requests["/testsystem.zip"]).Should(Equal(1))
+				Expect(requests["/v2/testsystem.zip"]).Should(Equal(1))
+				Expect(filepath.Glob(path.Join(cacheDir, "system1-*.zip"))).Should(HaveLen(2))
+			})
+
+			It("should download a corrupt cached bundle again", func() {
+				Expect(stage(server.URL+"/testsystem.zip", "")).To(BeNil())
+
+				cached, err := filepath.Glob(path.Join(cacheDir, "system1-*.zip"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(cached).Should(HaveLen(1))
+
+				//truncated
+				Expect(ioutil.WriteFile(cached[0], []byte("PK"), 0644)).To(Succeed())
+
+				Expect(stage(server.URL+"/testsystem.zip", "")).To(BeNil())
+				Expect(requests["/testsystem.zip"]).Should(Equal(2))
+			})
+
+			It("should not keep a download that fails verification", func() {
+				deploymentErr := stage(server.URL+"/testsystem.zip", "deadbeef")
+				Expect(deploymentErr).NotTo(BeNil())
+				Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeVerificationFailed))
+
+				Expect(filepath.Glob(path.Join(cacheDir, "*.zip"))).Should(BeEmpty())
+
+				//so it's fetched again next time
+				stage(server.URL+"/testsystem.zip", "deadbeef")
+				Expect(requests["/testsystem.zip"]).Should(Equal(2))
+			})
+		})
+
+		It("should not modify cached bundles when templating", func() {
+
+			cacheDir, err := ioutil.TempDir("", "bundleCache")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(cacheDir)
+
+			deployment := &client.Deployment{
+				ID: "deployment_id",
+				System: &client.SystemBundle{
+					BundleID: "system1",
+					URL: "file://../test/testsystem.zip",
+				},
+			}
+
+			stageManager := &nginx.StageManagerImpl{
+				Cache: nginx.NewBundleCache(cacheDir, 0),
+			}
+
+			stageDir, deploymentErr := stageManager.Stage(context.Background(), deployment)
+			if stageDir != "" {
+				defer os.RemoveAll(stageDir)
+			}
+			Expect(deploymentErr).To(BeNil())
+
+			entries, err := ioutil.ReadDir(cacheDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).Should(HaveLen(1))
+
+			cachedConf, err := ioutil.ReadFile(path.Join(cacheDir, entries[0].Name(), "nginx.conf"))
+			Expect(err).NotTo(HaveOccurred())
+
+			stagedConf, err := ioutil.ReadFile(path.Join(stageDir, "nginx.conf"))
+			Expect(err).NotTo(HaveOccurred())
+
+			//the cache still has the template, the deployment has the output
+			Expect(string(cachedConf)).Should(ContainSubstring("{{"))
+			Expect(string(stagedConf)).ShouldNot(ContainSubstring("{{"))
+		})
+
+		It("should fail bundles that don't match their checksum", func() {
+
+			bundles := make([]*client.DeploymentBundle, 2)
+			bundles[0] = &client.DeploymentBundle{
+				BundleID: "bundle1",
+				URL: "file://../test/testbundle.zip",
+			}
+			bundles[1] = &client.DeploymentBundle{
+				BundleID: "bundle2",
+				URL: "file://../test/testbundle.zip",
+				Checksum: "deadbeef",
+			}
+
+			deployment := &client.Deployment{
+				ID: "deployment_id",
+				System: &client.SystemBundle{
+					BundleID: "system1",
+					URL: "file://../test/testsystem.zip",
+				},
+				Bundles: bundles,
+			}
+
+			stageDir, deploymentErr := nginx.Stage(context.Background(), deployment)
+			if stageDir != "" {
+				defer os.RemoveAll(stageDir)
+			}
+			Expect(deploymentErr).NotTo(BeNil())
+			Expect(deploymentErr.BundleErrors).Should(HaveLen(1))
+			Expect(deploymentErr.BundleErrors[0].BundleID).Should(Equal("bundle2"))
+			Expect(deploymentErr.BundleErrors[0].Reason).Should(ContainSubstring("Checksum mismatch"))
+			Expect(deploymentErr.BundleErrors[0].ErrorCode).Should(Equal(client.ErrorCodeVerificationFailed))
+			Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeVerificationFailed))
+
+			//nothing was unzipped
+			Expect(path.Join(stageDir, "nginx.conf")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should require signatures when there are trusted keys", func() {
+
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+
+			deployment := &client.Deployment{
+				ID: "deployment_id",
+				System: &client.SystemBundle{
+					BundleID: "system1",
+					URL: "file://../test/testsystem.zip",
+				},
+			}
+
+			stageManager := &nginx.StageManagerImpl{
+				TrustedKeys: []crypto.PublicKey{key.Public()},
+			}
+
+			stageDir, deploymentErr := stageManager.Stage(context.Background(), deployment)
+			if stageDir != "" {
+				defer os.RemoveAll(stageDir)
+			}
+			Expect(deploymentErr).NotTo(BeNil())
+			Expect(deploymentErr.BundleErrors).Should(HaveLen(1))
+			Expect(deploymentErr.BundleErrors[0].BundleID).Should(Equal("system1"))
+			Expect(deploymentErr.BundleErrors[0].Reason).Should(ContainSubstring("not signed"))
+		})
+
+		It("should fail when a bundle can't be downloaded", func() {
+
+			server := httptest.NewServer(http.NotFoundHandler())
+			defer server.Close()
+
+			cacheDir, err := ioutil.TempDir("", "bundleCache")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(cacheDir)
+
+			deployment := &client.Deployment{
+				ID: "deployment_id",
+				System: &client.SystemBundle{
+					BundleID: "system1",
+					URL: server.URL + "/testsystem.zip",
+				},
+			}
+
+			stageManager := &nginx.StageManagerImpl{
+				BundleCacheDir: cacheDir,
+			}
+
+			stageDir, deploymentErr := stageManager.Stage(context.Background(), deployment)
+			if stageDir != "" {
+				defer os.RemoveAll(stageDir)
+			}
+			Expect(deploymentErr).NotTo(BeNil())
+			Expect(deploymentErr.Reason).Should(ContainSubstring("404"))
+			Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeDownloadFailed))
+
+			//nothing partial is left behind
+			files, err := ioutil.ReadDir(cacheDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).Should(BeEmpty())
+		})
 	})
 
 })
@@ -0,0 +1,192 @@
+package nginx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/30x/keymaster/client"
+)
+
+//managerState what we persist of the manager, so a restarted keymaster carries on with the deployment nginx is running
+type managerState struct {
+	Deployment         *client.Deployment `json:"deployment"`
+	StagedDir          string             `json:"stagedDir"`
+	AppliedAt          time.Time          `json:"appliedAt"`
+	PreviousDeployment *client.Deployment `json:"previousDeployment"`
+	PreviousStagedDir  string             `json:"previousStagedDir"`
+}
+
+//SetStateFile persist the running deployment to the file, so it can be restored with Restore after a restart.  Empty disables persistence
+func (manager *Manager) SetStateFile(stateFile string) {
+	manager.stateFile = stateFile
+}
+
+//Restore carry on with the deployment in the state file from a previous run, rather than staging and reloading it again.
+//nginx is started with the deployment if it isn't running, or reloaded with it if the health check shows it's serving something else.
+//Without a health checker we can't tell what nginx is serving, so it's always reloaded
+//A missing state file isn't an error, there's nothing to restore
+func (manager *Manager) Restore() error {
+	manager.applyMutex.Lock()
+	defer manager.applyMutex.Unlock()
+
+	if manager.stateFile == "" {
+		return nil
+	}
+
+	state, err := readState(manager.stateFile)
+	if err != nil {
+		return err
+	}
+
+	if state == nil || state.Deployment == nil {
+		return nil
+	}
+
+	systemFile := path.Join(state.StagedDir, systemFileName)
+
+	_, err = os.Stat(systemFile)
+	if err != nil {
+		return fmt.Errorf("Unable to restore deployment %s, it's no longer staged.  %s", state.Deployment.ID, err)
+	}
+
+	isRunning, err := manager.controller.Status()
+	if err != nil {
+		return err
+	}
+
+	needsApply := !isRunning || manager.healthChecker == nil
+
+	//running, but maybe not with our config
+	if !needsApply {
+		err = manager.healthChecker.Check(state.Deployment)
+
+		if err != nil {
+			log.Printf("nginx is not serving deployment %s, reloading it.  %s", state.Deployment.ID, err)
+			needsApply = true
+		}
+	}
+
+	if needsApply {
+		_, err = manager.reloadOrStart(context.Background(), state.StagedDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	manager.mutex.Lock()
+
+	manager.lastApidDeployment = state.Deployment
+	manager.lastUnzippedDeployment = state.StagedDir
+	manager.lastAppliedAt = state.AppliedAt
+
+	//only keep the previous deployment if we can still roll back to it
+	if _, err := os.Stat(path.Join(state.PreviousStagedDir, systemFileName)); err == nil && state.PreviousDeployment != nil {
+		manager.previousApidDeployment = state.PreviousDeployment
+		manager.previousUnzippedDeployment = state.PreviousStagedDir
+	}
+
+	manager.mutex.Unlock()
+
+	log.Printf("Restored deployment %s from %s", state.Deployment.ID, state.StagedDir)
+
+	return nil
+}
+
+//saveState persist the running deployment to the state file.  Failing to persist doesn't fail the deployment, so errors are only logged
+func (manager *Manager) saveState() {
+	if manager.stateFile == "" {
+		return
+	}
+
+	manager.mutex.RLock()
+
+	state := &managerState{
+		Deployment:         manager.lastApidDeployment,
+		StagedDir:          manager.lastUnzippedDeployment,
+		AppliedAt:          manager.lastAppliedAt,
+		PreviousDeployment: manager.previousApidDeployment,
+		PreviousStagedDir:  manager.previousUnzippedDeployment,
+	}
+
+	manager.mutex.RUnlock()
+
+	err := writeState(manager.stateFile, state)
+
+	if err != nil {
+		log.Printf("Unable to save state to %s.  Error is %s", manager.stateFile, err)
+	}
+}
+
+//clearState remove the state file, nothing is running that can be restored
+func (manager *Manager) clearState() {
+	if manager.stateFile == "" {
+		return
+	}
+
+	err := os.Remove(manager.stateFile)
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove state file %s.  Error is %s", manager.stateFile, err)
+	}
+}
+
+//readState read the state file.  Returns nil if it doesn't exist
+func readState(stateFile string) (*managerState, error) {
+	data, err := ioutil.ReadFile(stateFile)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := &managerState{}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse state file %s.  %s", stateFile, err)
+	}
+
+	return state, nil
+}
+
+//writeState write the state to a temp file and move it into place, so a crash never leaves a partial state file.
+//Bundle auth codes are in the deployment, so only we can read it
+func writeState(stateFile string, state *managerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(stateFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(stateFile), filepath.Base(stateFile))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), stateFile)
+}
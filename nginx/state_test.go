@@ -0,0 +1,166 @@
+package nginx_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/nginx"
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("State", func() {
+
+	var tmpDir string
+	var stateFile string
+	var pidFile string
+	var proxy *proxyTester
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = util.MkTempDir("", "state", 0755)
+		Expect(err).NotTo(HaveOccurred())
+
+		stateFile = path.Join(tmpDir, "state.json")
+
+		//nginx is "running" as this process, so restoring doesn't need to run nginx
+		pidFile = path.Join(tmpDir, "nginx.pid")
+		err = ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		proxy = &proxyTester{running: true}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	//writeState write a state file as a previous run would have, with a staged dir for the deployment
+	writeState := func(deployment *client.Deployment) string {
+		stagedDir := path.Join(tmpDir, deployment.ID)
+
+		Expect(os.Mkdir(stagedDir, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path.Join(stagedDir, "nginx.conf"), []byte(""), 0644)).To(Succeed())
+
+		data, err := json.Marshal(map[string]interface{}{
+			"deployment": deployment,
+			"stagedDir":  stagedDir,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(stateFile, data, 0600)).To(Succeed())
+
+		return stagedDir
+	}
+
+	It("should restore the running deployment without staging it again", func() {
+		deployment := &client.Deployment{
+			ID:   "deployment_id_restored",
+			ETAG: "deployment_id_restored-1",
+		}
+
+		stagedDir := writeState(deployment)
+
+		apiClient := &apiClientTester{
+			mockDeployment: deployment,
+		}
+
+		stager := &stageTester{
+			err: &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: "Should not stage"},
+		}
+
+		manager := nginx.NewManager(apiClient, stager, "", pidFile, 1)
+		manager.SetProxyController(proxy)
+		manager.SetStateFile(stateFile)
+
+		Expect(manager.Restore()).To(Succeed())
+
+		status := manager.Status()
+		Expect(status.DeploymentID).Should(Equal(deployment.ID))
+		Expect(status.ETag).Should(Equal(deployment.ETAG))
+		Expect(status.StagedDir).Should(Equal(stagedDir))
+
+		//without a health check we can't tell what nginx is serving, so it's reloaded once
+		Expect(proxy.commands).Should(Equal([]string{"reload " + stagedDir}))
+
+		//apid still has the same deployment, nothing is applied or reported
+		Expect(manager.ApplyDeployment(context.Background())).Should(Equal(nginx.ErrNoNewDeployment))
+		Expect(apiClient.deploymentResult).Should(BeNil())
+		Expect(proxy.commands).Should(HaveLen(1))
+	})
+
+	It("should not reload nginx if it's already serving the restored deployment", func() {
+		deployment := &client.Deployment{ID: "deployment_id_restored"}
+
+		writeState(deployment)
+
+		manager := nginx.NewManager(&apiClientTester{}, &stageTester{}, "", pidFile, 1)
+		manager.SetProxyController(proxy)
+		manager.SetHealthChecker(&healthTester{})
+		manager.SetStateFile(stateFile)
+
+		Expect(manager.Restore()).To(Succeed())
+		Expect(proxy.commands).Should(BeEmpty())
+		Expect(manager.Status().DeploymentID).Should(Equal(deployment.ID))
+	})
+
+	It("should reload nginx if it's serving something else", func() {
+		deployment := &client.Deployment{ID: "deployment_id_restored"}
+
+		stagedDir := writeState(deployment)
+
+		manager := nginx.NewManager(&apiClientTester{}, &stageTester{}, "", pidFile, 1)
+		manager.SetProxyController(proxy)
+		manager.SetHealthChecker(&healthTester{
+			errs: map[string]error{deployment.ID: errors.New("status reports deployment_id_other")},
+		})
+		manager.SetStateFile(stateFile)
+
+		Expect(manager.Restore()).To(Succeed())
+		Expect(proxy.commands).Should(Equal([]string{"reload " + stagedDir}))
+	})
+
+	It("should start nginx if it isn't running", func() {
+		deployment := &client.Deployment{ID: "deployment_id_restored"}
+
+		stagedDir := writeState(deployment)
+
+		proxy.running = false
+
+		manager := nginx.NewManager(&apiClientTester{}, &stageTester{}, "", pidFile, 1)
+		manager.SetProxyController(proxy)
+		manager.SetStateFile(stateFile)
+
+		Expect(manager.Restore()).To(Succeed())
+		Expect(proxy.commands).Should(Equal([]string{"start " + stagedDir}))
+	})
+
+	It("should not restore a deployment that's no longer staged", func() {
+		deployment := &client.Deployment{
+			ID: "deployment_id_removed",
+		}
+
+		stagedDir := writeState(deployment)
+		Expect(os.RemoveAll(stagedDir)).To(Succeed())
+
+		manager := nginx.NewManager(&apiClientTester{}, &stageTester{}, "", pidFile, 1)
+		manager.SetStateFile(stateFile)
+
+		Expect(manager.Restore()).ShouldNot(Succeed())
+		Expect(manager.Status().DeploymentID).Should(BeEmpty())
+	})
+
+	It("should do nothing without a state file", func() {
+		manager := nginx.NewManager(&apiClientTester{}, &stageTester{}, "", pidFile, 1)
+		manager.SetStateFile(stateFile)
+
+		Expect(manager.Restore()).To(Succeed())
+		Expect(manager.Status().DeploymentID).Should(BeEmpty())
+	})
+})
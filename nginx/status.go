@@ -0,0 +1,205 @@
+package nginx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/30x/keymaster/client"
+)
+
+const (
+	//StatusAddress the address nginx serves the status of the running deployment on
+	StatusAddress = "127.0.0.1:5280"
+	//statusFileName the file in the deployment dir the status is served from
+	statusFileName = "status.json"
+)
+
+//httpBlockRegex matches the opening of the http block
+var httpBlockRegex = regexp.MustCompile(`(?m)^\s*http\s*\{`)
+
+//statusListenRegex matches a listen directive for the status address
+var statusListenRegex = regexp.MustCompile(`(?m)^\s*listen\s+` + regexp.QuoteMeta(StatusAddress) + `[\s;]`)
+
+//deploymentStatus the JSON served at the status address
+type deploymentStatus struct {
+	DeploymentID string `json:"deploymentId"`
+	//AppliedAt when nginx started serving the deployment, in RFC3339.  Empty until it has
+	AppliedAt string         `json:"appliedAt"`
+	Bundles   []bundleStatus `json:"bundles"`
+}
+
+type bundleStatus struct {
+	BundleID     string   `json:"bundleId"`
+	BasePath     string   `json:"basePath"`
+	VirtualHosts []string `json:"virtualHosts"`
+}
+
+//writeStatusFile write the status of the deployment to the status file in the deployment dir.  Returns the path of the file.
+//It isn't applied yet, setStatusAppliedAt records when it is
+func writeStatusFile(deploymentDir string, deployment *client.Deployment) (string, error) {
+	status := &deploymentStatus{
+		DeploymentID: deployment.ID,
+		Bundles:      []bundleStatus{},
+	}
+
+	for _, b := range deployment.Bundles {
+		status.Bundles = append(status.Bundles, bundleStatus{
+			BundleID:     b.BundleID,
+			BasePath:     b.BasePath,
+			VirtualHosts: b.VirtualHosts,
+		})
+	}
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	statusFile := path.Join(deploymentDir, statusFileName)
+
+	return statusFile, ioutil.WriteFile(statusFile, data, 0644)
+}
+
+//setStatusAppliedAt record when nginx started serving the deployment in its status file.  nginx serves the file from disk, so it's seen without a reload.
+//A deployment without a status file, e.g. one staged for another proxy, is left alone
+func setStatusAppliedAt(deploymentDir string, appliedAt time.Time) error {
+	statusFile := path.Join(deploymentDir, statusFileName)
+
+	data, err := ioutil.ReadFile(statusFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	status := &deploymentStatus{}
+
+	err = json.Unmarshal(data, status)
+	if err != nil {
+		return err
+	}
+
+	status.AppliedAt = appliedAt.UTC().Format(time.RFC3339)
+
+	data, err = json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	//replace it in one go, nginx may be serving it
+	tmpFile := statusFile + ".tmp"
+
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, statusFile)
+}
+
+//statusServer the server block serving the status file.  The staged dir is named after the deployment ID from apid, so it's quoted
+func statusServer(statusFile string) string {
+	return fmt.Sprintf(`
+  # status of the running deployment, added by keymaster
+  server {
+    listen %s;
+
+    location / {
+      default_type application/json;
+      root %s;
+      try_files /%s =404;
+    }
+  }
+`, StatusAddress, quote(path.Dir(statusFile)), path.Base(statusFile))
+}
+
+//injectStatusServer add the status server block to the end of the http block of the rendered config, unless the config already listens on the status address
+func injectStatusServer(configFile, statusFile string) error {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	config := string(data)
+
+	if statusListenRegex.MatchString(config) {
+		return nil
+	}
+
+	start := httpBlockRegex.FindStringIndex(config)
+	if start == nil {
+		return fmt.Errorf("Unable to add the status server, %s has no http block", path.Base(configFile))
+	}
+
+	end := closingBrace(config, start[1]-1)
+	if end < 0 {
+		return fmt.Errorf("Unable to add the status server, the http block in %s is not closed", path.Base(configFile))
+	}
+
+	config = config[:end] + statusServer(statusFile) + config[end:]
+
+	return ioutil.WriteFile(configFile, []byte(config), 0644)
+}
+
+//closingBrace the index of the brace that closes the one at open, or -1 if it isn't closed.
+//Escaped braces and braces in quoted strings and # comments don't count, as nginx doesn't count them.  Like nginx, quotes and comments only start a token
+func closingBrace(config string, open int) int {
+	depth := 0
+	//tokenStart true if the next character starts a token, the only place a # starts a comment
+	tokenStart := true
+
+	for i := open; i < len(config); i++ {
+		c := config[i]
+
+		switch {
+		case c == '\\':
+			//escapes the next character
+			i++
+		case (c == '"' || c == '\'') && tokenStart:
+			i = closingQuote(config, i)
+			if i < 0 {
+				return -1
+			}
+		case c == '#' && tokenStart:
+			for i < len(config) && config[i] != '\n' {
+				i++
+			}
+
+			tokenStart = true
+			continue
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+
+			if depth == 0 {
+				return i
+			}
+		}
+
+		tokenStart = c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ';' || c == '{' || c == '}'
+	}
+
+	return -1
+}
+
+//closingQuote the index of the quote that closes the one at open, skipping escaped characters.  -1 if it isn't closed
+func closingQuote(config string, open int) int {
+	for i := open + 1; i < len(config); i++ {
+		switch config[i] {
+		case '\\':
+			i++
+		case config[open]:
+			return i
+		}
+	}
+
+	return -1
+}
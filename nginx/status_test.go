@@ -0,0 +1,142 @@
+package nginx_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/nginx"
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Status", func() {
+
+	var stageDir string
+	var deployment *client.Deployment
+
+	BeforeEach(func() {
+		deployment = &client.Deployment{
+			ID: "deployment_id",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "bundle1", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+			},
+		}
+
+		var err error
+		stageDir, err = util.MkTempDir("", deployment.ID, 0755)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = copyDirRecursive("../test/template/testsystem", stageDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = copyDirRecursive("../test/template/testbundle", path.Join(stageDir, "bundle1"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stageDir)
+	})
+
+	It("should write the status of the deployment", func() {
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		data, err := ioutil.ReadFile(path.Join(stageDir, "status.json"))
+		Expect(err).NotTo(HaveOccurred())
+
+		status := make(map[string]interface{})
+		Expect(json.Unmarshal(data, &status)).To(Succeed())
+
+		Expect(status["deploymentId"]).Should(Equal("deployment_id"))
+		Expect(status["bundles"]).Should(HaveLen(1))
+
+		//it's not applied until nginx is serving it
+		Expect(status["appliedAt"]).Should(BeEmpty())
+	})
+
+	It("should close the http block past braces in strings and comments", func() {
+		nginxConf := path.Join(stageDir, "nginx.conf")
+
+		data, err := ioutil.ReadFile(nginxConf)
+		Expect(err).NotTo(HaveOccurred())
+
+		//none of these braces open or close a block
+		tricky := "http {\n  # a comment with a closing brace }\n  log_format braces '{ \"a\": \"}\" }';\n  map $uri $brace { default \"}\"; }\n"
+		config := strings.Replace(string(data), "http {\n", tricky, 1)
+
+		Expect(ioutil.WriteFile(nginxConf, []byte(config), 0644)).To(Succeed())
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		data, err = ioutil.ReadFile(nginxConf)
+		Expect(err).NotTo(HaveOccurred())
+
+		rendered := strings.TrimSpace(string(data))
+
+		//still at the end of the http block, not inside the comment, the string or the map
+		Expect(strings.Index(rendered, "listen "+nginx.StatusAddress)).Should(BeNumerically(">", strings.Index(rendered, "map $uri $brace")))
+		Expect(rendered).Should(ContainSubstring("# a comment with a closing brace }\n"))
+		Expect(rendered).Should(ContainSubstring(`log_format braces '{ "a": "}" }';`))
+		Expect(rendered).Should(HaveSuffix("}"))
+	})
+
+	It("should add a status server to the http block", func() {
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		data, err := ioutil.ReadFile(path.Join(stageDir, "nginx.conf"))
+		Expect(err).NotTo(HaveOccurred())
+
+		config := strings.TrimSpace(string(data))
+
+		Expect(strings.Count(config, "listen "+nginx.StatusAddress+";")).Should(Equal(1))
+		Expect(config).Should(ContainSubstring(`root "` + stageDir + `"`))
+
+		//inside the http block, which is the last block in the file
+		Expect(strings.Index(config, "listen "+nginx.StatusAddress)).Should(BeNumerically(">", strings.Index(config, "http {")))
+		Expect(config).Should(HaveSuffix("}"))
+	})
+
+	It("should quote the staged dir, which is named after the deployment", func() {
+		deployment.ID = `deploy"; evil`
+
+		quotedDir, err := util.MkTempDir("", deployment.ID, 0755)
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(quotedDir)
+
+		Expect(copyDirRecursive(stageDir, quotedDir)).To(Succeed())
+
+		Expect(nginx.Template(quotedDir, deployment)).To(BeNil())
+
+		data, err := ioutil.ReadFile(path.Join(quotedDir, "nginx.conf"))
+		Expect(err).NotTo(HaveOccurred())
+
+		escapedDir := strings.Replace(quotedDir, `"`, `\"`, -1)
+		Expect(string(data)).Should(ContainSubstring(`root "` + escapedDir + `";`))
+	})
+
+	It("should not add a status server if the system bundle defines one", func() {
+		nginxConf := path.Join(stageDir, "nginx.conf")
+
+		data, err := ioutil.ReadFile(nginxConf)
+		Expect(err).NotTo(HaveOccurred())
+
+		//serve the status from the system template instead
+		statusBlock := "http {\n  server {\n    listen {{ .StatusAddress }};\n    location / { return 200 '{{ .DeploymentID }}'; }\n  }\n"
+		config := strings.Replace(string(data), "http {\n", statusBlock, 1)
+
+		Expect(ioutil.WriteFile(nginxConf, []byte(config), 0644)).To(Succeed())
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		data, err = ioutil.ReadFile(nginxConf)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(strings.Count(string(data), "listen "+nginx.StatusAddress+";")).Should(Equal(1))
+		Expect(string(data)).Should(ContainSubstring("return 200 'deployment_id';"))
+		Expect(string(data)).ShouldNot(ContainSubstring("added by keymaster"))
+	})
+})
@@ -2,10 +2,12 @@ package nginx
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"text/template"
 
@@ -13,10 +15,35 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+//fragmentsDir the directory in a bundle its nginx config fragments are in
+const fragmentsDir = "nginx"
+
+//fragmentSuffix the suffix of a fragment or system template.  The template is rendered to the same name without it
+const fragmentSuffix = ".tmpl"
+
+//errTemplateFailed stops walking the system bundle once a template has failed
+var errTemplateFailed = errors.New("Rendering a template failed")
+
 type bundleMetadataDef struct {
 	Pipes map[string]string `json:"pipes"`
 }
 
+//readBundleMetadata read and parse the bundle.yaml in the bundle dir
+func readBundleMetadata(bundlePath string) (*bundleMetadataDef, error) {
+	yamlBytes, err := ioutil.ReadFile(path.Join(bundlePath, "bundle.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	bundleMetadata := &bundleMetadataDef{}
+	err = yaml.Unmarshal(yamlBytes, bundleMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return bundleMetadata, nil
+}
+
 func Template(deploymentDir string, deployment *client.Deployment) *client.DeploymentError {
 
 	bundles := make(map[string]bundle)
@@ -24,18 +51,14 @@ func Template(deploymentDir string, deployment *client.Deployment) *client.Deplo
 	for _, b := range deployment.Bundles {
 		bundlePath := path.Join(deploymentDir, b.BundleID)
 
-		yamlBytes, err := ioutil.ReadFile(path.Join(bundlePath, "bundle.yaml"))
+		bundleMetadata, err := readBundleMetadata(bundlePath)
 		if err != nil {
-			return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
-		}
-		bundleMetadata := bundleMetadataDef{}
-		err = yaml.Unmarshal(yamlBytes, &bundleMetadata)
-		if err != nil {
-			return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+			return &client.DeploymentError{ErrorCode: client.ErrorCodeBundleInvalid, Reason: err.Error()}
 		}
 		pipePaths := bundleMetadata.Pipes
 		if pipePaths == nil {
-			return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+			errMsg := fmt.Sprintf("No pipes are defined in bundle %s", b.BundleID)
+			return &client.DeploymentError{ErrorCode: client.ErrorCodeBundleInvalid, Reason: errMsg}
 		}
 		pathPipes := make(map[string]string)
 		for k, v := range pipePaths {
@@ -45,7 +68,7 @@ func Template(deploymentDir string, deployment *client.Deployment) *client.Deplo
 		pipesDir := path.Join(bundlePath, "pipes")
 		fis, err := ioutil.ReadDir(pipesDir)
 		if err != nil {
-			return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+			return &client.DeploymentError{ErrorCode: client.ErrorCodePipeMissing, Reason: err.Error()}
 		}
 
 		pipes := make(map[string]pipe)
@@ -57,7 +80,7 @@ func Template(deploymentDir string, deployment *client.Deployment) *client.Deplo
 
 				if pipePath == "" {
 					errMsg := fmt.Sprintf("Pipe named %s does not exist in bundle %s", pipeName, b.BundleID)
-					return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: errMsg}
+					return &client.DeploymentError{ErrorCode: client.ErrorCodePipeMissing, Reason: errMsg}
 				}
 
 				p := pipe{
@@ -73,48 +96,214 @@ func Template(deploymentDir string, deployment *client.Deployment) *client.Deplo
 
 		bn := bundle{
 			bundlePath:   bundlePath,
+			ID:           b.BundleID,
 			VirtualHosts: b.VirtualHosts,
 			Basepath:     b.BasePath,
 			Target:       b.Target,
 			Pipes:        pipes,
+			OrderedPipes: orderPipes(pipes),
+		}
+
+		fragments, deploymentError := renderFragments(bn)
+		if deploymentError != nil {
+			return deploymentError
 		}
+
+		bn.Fragments = fragments
 		bundles[b.BundleID] = bn
 	}
 
+	statusFile, err := writeStatusFile(deploymentDir, deployment)
+	if err != nil {
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
+	}
+
+	bundleIDs := []string{}
+	for _, b := range deployment.Bundles {
+		bundleIDs = append(bundleIDs, b.BundleID)
+	}
+
+	orderedBundles := sortedBundles(bundles)
+
 	nginxConfContext := &templateContext{
-		deployment:    deployment,
-		deploymentDir: deploymentDir,
-		Bundles:       bundles,
+		deployment:     deployment,
+		deploymentDir:  deploymentDir,
+		Bundles:        bundles,
+		OrderedBundles: orderedBundles,
+		VirtualHosts:   groupVirtualHosts(orderedBundles),
+		DeploymentID:   deployment.ID,
+		BundleIDs:      bundleIDs,
+		StatusAddress:  StatusAddress,
+		StatusFile:     statusFile,
+	}
+
+	deploymentError := renderSystemTemplates(deploymentDir, deployment, nginxConfContext)
+	if deploymentError != nil {
+		return deploymentError
+	}
+
+	nginxConfTemplate := path.Join(deploymentDir, systemFileName)
+
+	//a system bundle with nginx.conf.tmpl has already had it rendered, rendering the output again would template it twice
+	_, err = os.Stat(nginxConfTemplate + fragmentSuffix)
+	if os.IsNotExist(err) {
+		deploymentError = runTemplate(nginxConfTemplate, nginxConfContext)
+		if deploymentError != nil {
+			deploymentError.Reason = fmt.Sprintf("Unable to render %s.  %s", systemFileName, deploymentError.Reason)
+			return deploymentError
+		}
+	} else if err != nil {
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
+	}
+
+	//serve the status ourselves if the system bundle doesn't
+	err = injectStatusServer(nginxConfTemplate, statusFile)
+	if err != nil {
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeTemplateError, Reason: err.Error()}
+	}
+
+	return nil
+}
+
+//renderSystemTemplates render every *.tmpl file in the system bundle with the template context, to the same name without the .tmpl suffix.
+//The bundles' directories are skipped, their fragments are rendered with their own context
+func renderSystemTemplates(deploymentDir string, deployment *client.Deployment, context *templateContext) *client.DeploymentError {
+	bundleDirs := make(map[string]bool)
+	for _, b := range deployment.Bundles {
+		bundleDirs[filepath.Join(deploymentDir, b.BundleID)] = true
+	}
+
+	var deploymentError *client.DeploymentError
+
+	err := filepath.Walk(deploymentDir, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fileInfo.IsDir() {
+			if bundleDirs[filePath] {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !strings.HasSuffix(fileInfo.Name(), fragmentSuffix) {
+			return nil
+		}
+
+		renderError := renderTemplate(filePath, strings.TrimSuffix(filePath, fragmentSuffix), TemplateFuncs, context)
+		if renderError != nil {
+			relPath, _ := filepath.Rel(deploymentDir, filePath)
+			renderError.Reason = fmt.Sprintf("Unable to render %s.  %s", relPath, renderError.Reason)
+
+			deploymentError = renderError
+
+			//stop walking at the first file that fails
+			return errTemplateFailed
+		}
+
+		return nil
+	})
+
+	if deploymentError != nil {
+		return deploymentError
+	}
+
+	if err != nil {
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
 	}
 
-	nginxConfTemplate := path.Join(deploymentDir, "nginx.conf")
-	return runTemplate(nginxConfTemplate, nginxConfContext)
+	return nil
 }
 
+//renderFragments render the bundle's nginx/*.tmpl fragments with the bundle as their context.
+//Returns the rendered files by name, without the .tmpl suffix.  A bundle without fragments has none
+func renderFragments(b bundle) (map[string]string, *client.DeploymentError) {
+	fragments := make(map[string]string)
+
+	bundleFragmentsDir := path.Join(b.bundlePath, fragmentsDir)
+
+	fileInfos, err := ioutil.ReadDir(bundleFragmentsDir)
+	if os.IsNotExist(err) {
+		return fragments, nil
+	}
+
+	if err != nil {
+		return nil, &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
+	}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || !strings.HasSuffix(fileInfo.Name(), fragmentSuffix) {
+			continue
+		}
+
+		name := strings.TrimSuffix(fileInfo.Name(), fragmentSuffix)
+		fragmentFile := path.Join(bundleFragmentsDir, name)
+
+		deploymentError := renderTemplate(path.Join(bundleFragmentsDir, fileInfo.Name()), fragmentFile, FragmentFuncs, b)
+		if deploymentError != nil {
+			reason := fmt.Sprintf("Unable to render fragment %s of bundle %s.  %s", fileInfo.Name(), b.ID, deploymentError.Reason)
+
+			return nil, &client.DeploymentError{
+				ErrorCode: deploymentError.ErrorCode,
+				Reason:    reason,
+				BundleErrors: []client.BundleError{
+					{BundleID: b.ID, ErrorCode: deploymentError.ErrorCode, Reason: reason},
+				},
+			}
+		}
+
+		fragments[name] = fragmentFile
+	}
+
+	return fragments, nil
+}
+
+//runTemplate render the template in fileName with TemplateFuncs, replacing it with the output.
 func runTemplate(fileName string, context interface{}) *client.DeploymentError {
+	return renderTemplate(fileName, fileName, TemplateFuncs, context)
+}
+
+//renderTemplate render the template in templateFile with the funcs to outputFile.
+//The output is written to a new file and moved into place, since the template may be hard linked from the bundle cache
+func renderTemplate(templateFile, outputFile string, funcs template.FuncMap, context interface{}) *client.DeploymentError {
 
-	parsedTemplate, err := template.ParseFiles(fileName)
+	parsedTemplate, err := template.New(path.Base(templateFile)).Funcs(funcs).ParseFiles(templateFile)
 	if err != nil {
-		return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeTemplateError, Reason: err.Error()}
 	}
 
-	file, err := os.Create(fileName)
+	file, err := ioutil.TempFile(path.Dir(outputFile), path.Base(outputFile))
 	if err != nil {
-		return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
 	}
+	defer os.Remove(file.Name())
 
 	writer := bufio.NewWriter(file)
 	err = parsedTemplate.Execute(writer, context)
 	if err != nil {
-		return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+		file.Close()
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeTemplateError, Reason: err.Error()}
 	}
 	err = writer.Flush()
 	if err != nil {
-		return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+		file.Close()
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
 	}
 	err = file.Close()
 	if err != nil {
-		return &client.DeploymentError{ErrorCode: client.ErrorCodeTODO, Reason: err.Error()}
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
+	}
+
+	err = os.Chmod(file.Name(), 0644)
+	if err != nil {
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
+	}
+
+	err = os.Rename(file.Name(), outputFile)
+	if err != nil {
+		return &client.DeploymentError{ErrorCode: client.ErrorCodeInternal, Reason: err.Error()}
 	}
 
 	return nil
@@ -130,10 +319,15 @@ type pipe struct {
 type bundle struct {
 	bundlePath string
 
+	ID           string
 	VirtualHosts []string
 	Basepath     string
 	Target       string
 	Pipes        map[string]pipe
+	//OrderedPipes the pipes with the longest path first, then by name.  Use these rather than Pipes so the rendered config is the same every time
+	OrderedPipes []pipe
+	//Fragments the bundle's rendered nginx config fragments by name.  Include them in the system template with the include function
+	Fragments map[string]string
 }
 
 type templateContext struct {
@@ -141,4 +335,18 @@ type templateContext struct {
 	deploymentDir string
 
 	Bundles map[string]bundle
+	//OrderedBundles the bundles ordered by ID.  Use these rather than Bundles so the rendered config is the same every time
+	OrderedBundles []bundle
+	//VirtualHosts the bundles grouped by the virtual hosts they're served on, so each host can have its own server block
+	VirtualHosts []virtualHost
+
+	//DeploymentID the ID of the deployment being templated
+	DeploymentID string
+	//BundleIDs the IDs of the deployment's bundles, in the order apid sent them
+	BundleIDs []string
+	//StatusAddress the address the status of the deployment should be served on
+	StatusAddress string
+	//StatusFile the JSON status of the deployment.  A system template that listens on StatusAddress should serve it.
+	//When the deployment was applied is only in the status file, templates are rendered before nginx serves the deployment so it isn't known yet
+	StatusFile string
 }
@@ -1,10 +1,15 @@
 package nginx_test
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"text/template"
 
 	"github.com/30x/keymaster/client"
 	"github.com/30x/keymaster/nginx"
@@ -70,11 +75,467 @@ var _ = Describe("templating", func() {
 		cmd.Stdout = os.Stdout
 		cmd.Run()
 
-		err = nginx.TestConfig(stageDir, "nginx.conf")
+		err = nginx.TestConfig(context.Background(), stageDir, "nginx.conf")
 		Expect(err).NotTo(HaveOccurred())
 	})
 })
 
+var _ = Describe("template functions", func() {
+
+	//render execute the template text with the template functions
+	render := func(text string, data interface{}) string {
+		parsed, err := template.New("test").Funcs(nginx.TemplateFuncs).Parse(text)
+		Expect(err).NotTo(HaveOccurred())
+
+		buffer := &bytes.Buffer{}
+		Expect(parsed.Execute(buffer, data)).To(Succeed())
+
+		return buffer.String()
+	}
+
+	It("should normalize and join paths", func() {
+		Expect(render(`{{ cleanPath "basepath/" }}`, nil)).Should(Equal("/basepath"))
+		Expect(render(`{{ cleanPath "//basepath//pipe" }}`, nil)).Should(Equal("/basepath/pipe"))
+		Expect(render(`{{ cleanPath "" }}`, nil)).Should(Equal("/"))
+		Expect(render(`{{ joinPath "basepath" "/iloveapis/" }}`, nil)).Should(Equal("/basepath/iloveapis"))
+		Expect(render(`{{ joinPath "/basepath/" "/" }}`, nil)).Should(Equal("/basepath"))
+		Expect(render(`{{ joinPath "" "/" }}`, nil)).Should(Equal("/"))
+	})
+
+	It("should quote and escape nginx strings", func() {
+		Expect(render(`{{ quote . }}`, `/usr/local/lua/?.lua;;`)).Should(Equal(`"/usr/local/lua/?.lua;;"`))
+		Expect(render(`{{ quote . }}`, `say "hi" \ bye`)).Should(Equal(`"say \"hi\" \\ bye"`))
+		Expect(render(`{{ escape . }}`, `say "hi"`)).Should(Equal(`say \"hi\"`))
+	})
+
+	It("should sanitize upstream names", func() {
+		Expect(render(`{{ upstreamName . }}`, "bundle_pipe")).Should(Equal("bundle_pipe"))
+		Expect(render(`{{ upstreamName . }}`, "my-bundle.v2/pipe")).Should(Equal("my_bundle_v2_pipe"))
+		Expect(render(`{{ upstreamName . }}`, "2fast")).Should(Equal("_2fast"))
+		Expect(render(`{{ upstreamName . }}`, "")).Should(Equal("_"))
+	})
+
+	It("should look up the environment with defaults", func() {
+		os.Setenv("KEYMASTER_TEMPLATE_TEST", "/opt/gatekeeper")
+		defer os.Unsetenv("KEYMASTER_TEMPLATE_TEST")
+
+		Expect(render(`{{ env "KEYMASTER_TEMPLATE_TEST" | default "/usr/local" }}`, nil)).Should(Equal("/opt/gatekeeper"))
+		Expect(render(`{{ env "KEYMASTER_TEMPLATE_UNSET" | default "/usr/local" }}`, nil)).Should(Equal("/usr/local"))
+		Expect(render(`{{ .Missing | default 80 }}`, map[string]interface{}{})).Should(Equal("80"))
+		Expect(render(`{{ .Port | default 80 }}`, map[string]interface{}{"Port": 8080})).Should(Equal("8080"))
+	})
+
+	It("should sort bundles, and pipes longest path first", func() {
+		deployment := &client.Deployment{
+			ID: "deployment_sorted",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "bundleB", BasePath: "b"},
+				{BundleID: "bundleC", BasePath: "c"},
+				{BundleID: "bundleA", BasePath: "a"},
+			},
+		}
+
+		stageDir, err := util.MkTempDir("", deployment.ID, 0755)
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(stageDir)
+
+		for _, b := range deployment.Bundles {
+			Expect(copyDirRecursive("../test/template/testbundle", path.Join(stageDir, b.BundleID))).To(Succeed())
+		}
+
+		nginxConf := path.Join(stageDir, "nginx.conf")
+		err = ioutil.WriteFile(nginxConf, []byte(`http {
+{{- range sortedBundles .Bundles }}{{ $bundle := . }}{{ range .OrderedPipes }}
+# {{ $bundle.ID }} {{ .Name }} {{ .Path }}
+{{- end }}{{ end }}
+}`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		rendered, err := ioutil.ReadFile(nginxConf)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(rendered)).Should(HavePrefix(`http {
+# bundleA apikey /iloveapis
+# bundleA dump /
+# bundleB apikey /iloveapis
+# bundleB dump /
+# bundleC apikey /iloveapis
+# bundleC dump /
+`))
+	})
+
+	It("should render normalized locations in the test system template", func() {
+		deployment := &client.Deployment{
+			ID: "deployment_locations",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "bundle1", BasePath: "basepath/", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+			},
+		}
+
+		stageDir, err := util.MkTempDir("", deployment.ID, 0755)
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(stageDir)
+
+		Expect(copyDirRecursive("../test/template/testsystem", stageDir)).To(Succeed())
+		Expect(copyDirRecursive("../test/template/testbundle", path.Join(stageDir, "bundle1"))).To(Succeed())
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		rendered, err := ioutil.ReadFile(path.Join(stageDir, "nginx.conf"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(rendered)).Should(ContainSubstring("location /basepath {"))
+		Expect(string(rendered)).Should(ContainSubstring("location /basepath/iloveapis {"))
+		Expect(string(rendered)).Should(ContainSubstring(`set $goz_pipe "bundle1_apikey";`))
+		Expect(string(rendered)).ShouldNot(ContainSubstring("todo: ensure leading '/'"))
+	})
+})
+
+var _ = Describe("template ordering", func() {
+
+	deployment := &client.Deployment{
+		ID: "deployment_ordered",
+		Bundles: []*client.DeploymentBundle{
+			{BundleID: "bundleB", BasePath: "b", Target: "http://localhost", VirtualHosts: []string{"localhost:8081"}},
+			{BundleID: "bundleC", BasePath: "c", Target: "http://localhost", VirtualHosts: []string{"localhost:8082"}},
+			{BundleID: "bundleA", BasePath: "a", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+		},
+	}
+
+	var stageDir string
+
+	BeforeEach(func() {
+		stageDir = stageTemplateFixture(deployment, "../test/template/testbundle")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stageDir)
+	})
+
+	//render template the test system nginx.conf in the stage dir
+	render := func() string {
+		Expect(copyFile("../test/template/testsystem/nginx.conf", path.Join(stageDir, "nginx.conf"))).To(Succeed())
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		rendered, err := ioutil.ReadFile(path.Join(stageDir, "nginx.conf"))
+		Expect(err).NotTo(HaveOccurred())
+
+		return string(rendered)
+	}
+
+	It("should render identical deployments identically", func() {
+		first := render()
+
+		for i := 0; i < 10; i++ {
+			Expect(render()).Should(Equal(first))
+		}
+	})
+
+	It("should order bundles by ID and pipes longest path first", func() {
+		rendered := render()
+
+		locations := []string{}
+		for _, line := range strings.Split(rendered, "\n") {
+			line = strings.TrimSpace(line)
+
+			if strings.HasPrefix(line, "location /") && !strings.Contains(line, "location / {") {
+				locations = append(locations, line)
+			}
+		}
+
+		Expect(locations).Should(Equal([]string{
+			"location /a/iloveapis {", "location /a {",
+			"location /b/iloveapis {", "location /b {",
+			"location /c/iloveapis {", "location /c {",
+		}))
+	})
+})
+
+var _ = Describe("bundle fragments", func() {
+
+	deployment := &client.Deployment{
+		ID: "deployment_fragments",
+		Bundles: []*client.DeploymentBundle{
+			{BundleID: "plain", BasePath: "plain", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+			{BundleID: "fragmented", BasePath: "fragmented", Target: "http://localhost:9000", VirtualHosts: []string{"localhost:8081"}},
+		},
+	}
+
+	var stageDir string
+
+	BeforeEach(func() {
+		stageDir = stageTemplateFixture(deployment, "../test/template/testbundle")
+
+		//testbundle2 is testbundle with fragments
+		Expect(copyDirRecursive("../test/template/testbundle2", path.Join(stageDir, "fragmented"))).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stageDir)
+	})
+
+	It("should render fragments with the bundle and include them", func() {
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		fragmentFile := path.Join(stageDir, "fragmented", "nginx", "location.conf")
+
+		fragment, err := ioutil.ReadFile(fragmentFile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(fragment)).Should(Equal("add_header X-Bundle \"fragmented\";\nadd_header X-Bundle-Target \"http://localhost:9000\";\n"))
+
+		rendered, err := ioutil.ReadFile(path.Join(stageDir, "nginx.conf"))
+		Expect(err).NotTo(HaveOccurred())
+
+		//included in each of the bundle's locations, and nowhere else
+		Expect(strings.Count(string(rendered), "include \""+fragmentFile+"\";")).Should(Equal(2))
+		Expect(strings.Count(string(rendered), "include \"")).Should(Equal(2))
+	})
+
+	It("should report the bundle with a broken fragment", func() {
+		err := ioutil.WriteFile(path.Join(stageDir, "fragmented", "nginx", "location.conf.tmpl"), []byte("add_header X-Bundle {{ .Missing }};"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		deploymentErr := nginx.Template(stageDir, deployment)
+		Expect(deploymentErr).NotTo(BeNil())
+		Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeTemplateError))
+		Expect(deploymentErr.BundleErrors).Should(HaveLen(1))
+		Expect(deploymentErr.BundleErrors[0].BundleID).Should(Equal("fragmented"))
+		Expect(deploymentErr.BundleErrors[0].Reason).Should(ContainSubstring("location.conf.tmpl"))
+	})
+
+	It("should not let fragments read the environment", func() {
+		os.Setenv("KEYMASTER_TEMPLATE_SECRET", "s3cret")
+		defer os.Unsetenv("KEYMASTER_TEMPLATE_SECRET")
+
+		err := ioutil.WriteFile(path.Join(stageDir, "fragmented", "nginx", "location.conf.tmpl"), []byte(`add_header X-Secret "{{ env "KEYMASTER_TEMPLATE_SECRET" }}";`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		deploymentErr := nginx.Template(stageDir, deployment)
+		Expect(deploymentErr).NotTo(BeNil())
+		Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeTemplateError))
+		Expect(deploymentErr.BundleErrors).Should(HaveLen(1))
+		Expect(deploymentErr.BundleErrors[0].BundleID).Should(Equal("fragmented"))
+		Expect(deploymentErr.Reason).Should(ContainSubstring(`function "env" not defined`))
+	})
+})
+
+var _ = Describe("system templates", func() {
+
+	deployment := &client.Deployment{
+		ID: "deployment_system",
+		Bundles: []*client.DeploymentBundle{
+			{BundleID: "bundle1", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+		},
+	}
+
+	var stageDir string
+
+	BeforeEach(func() {
+		stageDir = stageTemplateFixture(deployment, "../test/template/testbundle2")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stageDir)
+	})
+
+	It("should render every template in the system bundle", func() {
+		Expect(os.Mkdir(path.Join(stageDir, "conf.d"), 0755)).To(Succeed())
+		err := ioutil.WriteFile(path.Join(stageDir, "conf.d", "bundles.conf.tmpl"), []byte(`{{ range .OrderedBundles }}# {{ .ID }} {{ .Basepath }}{{ end }}`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		mimeTypes, err := ioutil.ReadFile(path.Join(stageDir, "mime.types"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(mimeTypes)).Should(ContainSubstring("# rendered for deployment deployment_system"))
+		Expect(string(mimeTypes)).Should(ContainSubstring("application/x-yaml      yaml yml;"))
+
+		bundlesConf, err := ioutil.ReadFile(path.Join(stageDir, "conf.d", "bundles.conf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bundlesConf)).Should(Equal("# bundle1 basepath"))
+
+		//the bundle's fragments are rendered with the bundle, not the system context
+		fragment, err := ioutil.ReadFile(path.Join(stageDir, "bundle1", "nginx", "location.conf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(fragment)).Should(ContainSubstring("add_header X-Bundle \"bundle1\";"))
+	})
+
+	It("should report which template failed", func() {
+		Expect(os.Mkdir(path.Join(stageDir, "lua"), 0755)).To(Succeed())
+		err := ioutil.WriteFile(path.Join(stageDir, "lua", "config.lua.tmpl"), []byte(`return { deployment = "{{ .DeploymentID }" }`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		deploymentErr := nginx.Template(stageDir, deployment)
+		Expect(deploymentErr).NotTo(BeNil())
+		Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeTemplateError))
+		Expect(deploymentErr.Reason).Should(HavePrefix("Unable to render lua/config.lua.tmpl."))
+	})
+
+	It("should render nginx.conf.tmpl only once", func() {
+		Expect(os.Remove(path.Join(stageDir, "nginx.conf"))).To(Succeed())
+
+		//renders to a template action, which would be run if the output were rendered again
+		err := ioutil.WriteFile(path.Join(stageDir, "nginx.conf.tmpl"), []byte("http {\n  # {{ \"{{ .DeploymentID }}\" }}\n}\n"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		rendered, err := ioutil.ReadFile(path.Join(stageDir, "nginx.conf"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(rendered)).Should(ContainSubstring("# {{ .DeploymentID }}"))
+		Expect(string(rendered)).ShouldNot(ContainSubstring("# deployment_system"))
+	})
+
+	It("should report a broken nginx.conf", func() {
+		err := ioutil.WriteFile(path.Join(stageDir, "nginx.conf"), []byte(`http { {{ .Missing }} }`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		deploymentErr := nginx.Template(stageDir, deployment)
+		Expect(deploymentErr).NotTo(BeNil())
+		Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeTemplateError))
+		Expect(deploymentErr.Reason).Should(HavePrefix("Unable to render nginx.conf."))
+	})
+})
+
+var _ = Describe("virtual hosts", func() {
+
+	//renderServers template the deployment with the test system template.  Returns the listen, server_name and locations of each server block,
+	//the last of which is the status server
+	renderServers := func(deployment *client.Deployment) [][]string {
+		stageDir := stageTemplateFixture(deployment, "../test/template/testbundle")
+		defer os.RemoveAll(stageDir)
+
+		Expect(nginx.Template(stageDir, deployment)).To(BeNil())
+
+		rendered, err := ioutil.ReadFile(path.Join(stageDir, "nginx.conf"))
+		Expect(err).NotTo(HaveOccurred())
+
+		servers := [][]string{}
+
+		for _, block := range strings.Split(string(rendered), "server {")[1:] {
+			server := []string{}
+
+			for _, line := range strings.Split(block, "\n") {
+				line = strings.TrimSpace(line)
+
+				if strings.HasPrefix(line, "listen ") || strings.HasPrefix(line, "server_name ") || strings.HasPrefix(line, "location ") {
+					server = append(server, line)
+				}
+			}
+
+			servers = append(servers, server)
+		}
+
+		return servers
+	}
+
+	It("should render a server block for each virtual host", func() {
+		servers := renderServers(&client.Deployment{
+			ID: "deployment_hosts",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "shop", BasePath: "shop", Target: "http://localhost:9001", VirtualHosts: []string{"shop.example.com:8080"}},
+				{BundleID: "api", BasePath: "api", Target: "http://localhost:9002", VirtualHosts: []string{"api.example.com:8080", "API.example.com:8080"}},
+				{BundleID: "everywhere", BasePath: "health", Target: "http://localhost:9003"},
+			},
+		})
+
+		Expect(servers).Should(HaveLen(3))
+
+		//the host name is only in server_name, nginx listens on the port for every name
+		Expect(servers[0]).Should(Equal([]string{
+			"listen 8080;",
+			"server_name api.example.com;",
+			"location /health/iloveapis {",
+			"location /api/iloveapis {",
+			"location /health {",
+			"location /api {",
+		}))
+
+		Expect(servers[1]).Should(Equal([]string{
+			"listen 8080;",
+			"server_name shop.example.com;",
+			"location /health/iloveapis {",
+			"location /shop/iloveapis {",
+			"location /health {",
+			"location /shop {",
+		}))
+	})
+
+	It("should listen on IPs and wildcards without a server name", func() {
+		servers := renderServers(&client.Deployment{
+			ID: "deployment_addresses",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "internal", BasePath: "internal", Target: "http://localhost:9001", VirtualHosts: []string{"10.0.0.1:8080"}},
+				{BundleID: "wildcard", BasePath: "wildcard", Target: "http://localhost:9002", VirtualHosts: []string{"*:8081"}},
+				{BundleID: "any", BasePath: "any", Target: "http://localhost:9003", VirtualHosts: []string{"0.0.0.0:8082"}},
+				{BundleID: "port", BasePath: "port", Target: "http://localhost:9004", VirtualHosts: []string{"8083"}},
+			},
+		})
+
+		Expect(servers).Should(HaveLen(5))
+
+		Expect(servers[0][0]).Should(Equal("listen 10.0.0.1:8080;"))
+		Expect(servers[1][0]).Should(Equal("listen 8081;"))
+		Expect(servers[2][0]).Should(Equal("listen 8082;"))
+		Expect(servers[3][0]).Should(Equal("listen 8083;"))
+
+		for _, server := range servers[:4] {
+			Expect(server[1]).Should(HavePrefix("location "))
+		}
+	})
+
+	It("should listen on localhost rather than every interface", func() {
+		servers := renderServers(&client.Deployment{
+			ID: "deployment_localhost",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "local", BasePath: "local", Target: "http://localhost:9001", VirtualHosts: []string{"localhost:8081"}},
+				{BundleID: "public", BasePath: "public", Target: "http://localhost:9002", VirtualHosts: []string{"api.example.com:8081"}},
+			},
+		})
+
+		Expect(servers).Should(HaveLen(3))
+
+		Expect(servers[0][:2]).Should(Equal([]string{"listen 8081;", "server_name api.example.com;"}))
+		Expect(servers[1][:2]).Should(Equal([]string{"listen localhost:8081;", "server_name localhost;"}))
+	})
+
+	It("should serve every bundle on the default port when none declare a virtual host", func() {
+		servers := renderServers(&client.Deployment{
+			ID: "deployment_default_host",
+			Bundles: []*client.DeploymentBundle{
+				{BundleID: "bundleA", BasePath: "a", Target: "http://localhost:9001"},
+				{BundleID: "bundleB", BasePath: "b", Target: "http://localhost:9002"},
+			},
+		})
+
+		Expect(servers).Should(HaveLen(2))
+
+		Expect(servers[0]).Should(Equal([]string{
+			"listen 80;",
+			"location /a/iloveapis {",
+			"location /b/iloveapis {",
+			"location /a {",
+			"location /b {",
+		}))
+	})
+})
+
+//stageTemplateFixture stage the test system bundle, with a copy of the bundle fixture for each of the deployment's bundles.  Returns the stage dir
+func stageTemplateFixture(deployment *client.Deployment, bundleFixture string) string {
+	stageDir, err := util.MkTempDir("", deployment.ID, 0755)
+	Expect(err).NotTo(HaveOccurred())
+
+	Expect(copyDirRecursive("../test/template/testsystem", stageDir)).To(Succeed())
+
+	for _, b := range deployment.Bundles {
+		Expect(copyDirRecursive(bundleFixture, path.Join(stageDir, b.BundleID))).To(Succeed())
+	}
+
+	return stageDir
+}
+
 func copyDirRecursive(source, dest string) error {
 
 	sourceinfo, err := os.Stat(source)
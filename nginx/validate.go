@@ -0,0 +1,231 @@
+package nginx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/30x/keymaster/client"
+)
+
+//route a location a bundle's pipe will be served at
+type route struct {
+	bundleID string
+	pipeName string
+	path     string
+}
+
+//listenAddress a parsed virtual host.  An empty host listens on every address
+type listenAddress struct {
+	host string
+	port int
+}
+
+//ValidateDeployment check the unzipped bundles for problems that would break the deployment before we template it.
+//Detects invalid targets and virtual hosts, pipes without files, and pipes in different bundles served at the same path on overlapping virtual hosts.
+//Every problem is reported as a BundleError against the bundle that caused it
+func ValidateDeployment(deploymentDir string, deployment *client.Deployment) *client.DeploymentError {
+
+	bundleErrors := []client.BundleError{}
+
+	addError := func(bundleID string, errorCode int, format string, args ...interface{}) {
+		bundleErrors = append(bundleErrors, client.BundleError{
+			BundleID:  bundleID,
+			ErrorCode: errorCode,
+			Reason:    fmt.Sprintf(format, args...),
+		})
+	}
+
+	routes := make(map[string][]route)
+	hosts := make(map[string][]listenAddress)
+
+	for _, b := range deployment.Bundles {
+
+		err := validateTarget(b.Target)
+		if err != nil {
+			addError(b.BundleID, client.ErrorCodeDeploymentInvalid, "Target %s is invalid.  %s", b.Target, err)
+		}
+
+		seenHosts := make(map[string]bool)
+
+		for _, virtualHost := range b.VirtualHosts {
+			address, err := parseVirtualHost(virtualHost)
+			if err != nil {
+				addError(b.BundleID, client.ErrorCodeDeploymentInvalid, "Virtual host %s is invalid.  %s", virtualHost, err)
+				continue
+			}
+
+			if seenHosts[virtualHost] {
+				addError(b.BundleID, client.ErrorCodeDeploymentInvalid, "Virtual host %s is listed more than once", virtualHost)
+				continue
+			}
+
+			seenHosts[virtualHost] = true
+			hosts[b.BundleID] = append(hosts[b.BundleID], address)
+		}
+
+		bundleRoutes, problems := readRoutes(deploymentDir, b)
+		bundleErrors = append(bundleErrors, problems...)
+
+		routes[b.BundleID] = bundleRoutes
+	}
+
+	//now look for the same path served by more than one bundle on the same listener
+	for i, first := range deployment.Bundles {
+		for _, second := range deployment.Bundles[i+1:] {
+
+			if !hostsOverlap(hosts[first.BundleID], hosts[second.BundleID]) {
+				continue
+			}
+
+			for _, firstRoute := range routes[first.BundleID] {
+				for _, secondRoute := range routes[second.BundleID] {
+					if firstRoute.path != secondRoute.path {
+						continue
+					}
+
+					addError(first.BundleID, client.ErrorCodeConflict, "Path %s of pipe %s conflicts with pipe %s in bundle %s", firstRoute.path, firstRoute.pipeName, secondRoute.pipeName, second.BundleID)
+					addError(second.BundleID, client.ErrorCodeConflict, "Path %s of pipe %s conflicts with pipe %s in bundle %s", secondRoute.path, secondRoute.pipeName, firstRoute.pipeName, first.BundleID)
+				}
+			}
+		}
+	}
+
+	if len(bundleErrors) == 0 {
+		return nil
+	}
+
+	return &client.DeploymentError{
+		ErrorCode:    bundleErrors[0].ErrorCode,
+		Reason:       fmt.Sprintf("Deployment has %d problem(s).  First problem is in bundle %s: %s", len(bundleErrors), bundleErrors[0].BundleID, bundleErrors[0].Reason),
+		BundleErrors: bundleErrors,
+	}
+}
+
+//readRoutes read the bundle's pipes and the paths they're served at.  Returns the routes and any problems with the pipes
+func readRoutes(deploymentDir string, b *client.DeploymentBundle) ([]route, []client.BundleError) {
+	bundlePath := path.Join(deploymentDir, b.BundleID)
+
+	problem := func(errorCode int, format string, args ...interface{}) client.BundleError {
+		return client.BundleError{BundleID: b.BundleID, ErrorCode: errorCode, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	bundleMetadata, err := readBundleMetadata(bundlePath)
+	if err != nil {
+		return nil, []client.BundleError{problem(client.ErrorCodeBundleInvalid, "Unable to read bundle.yaml.  %s", err)}
+	}
+
+	if len(bundleMetadata.Pipes) == 0 {
+		return nil, []client.BundleError{problem(client.ErrorCodeBundleInvalid, "No pipes are defined in bundle.yaml")}
+	}
+
+	problems := []client.BundleError{}
+	routes := []route{}
+	definedPipes := make(map[string]bool)
+
+	//sort the paths so our errors are in a predictable order
+	pipePaths := []string{}
+	for pipePath := range bundleMetadata.Pipes {
+		pipePaths = append(pipePaths, pipePath)
+	}
+	sort.Strings(pipePaths)
+
+	for _, pipePath := range pipePaths {
+		pipeName := bundleMetadata.Pipes[pipePath]
+		definedPipes[pipeName] = true
+
+		_, err := os.Stat(path.Join(bundlePath, "pipes", pipeName+".yaml"))
+		if err != nil {
+			problems = append(problems, problem(client.ErrorCodePipeMissing, "Pipe %s at path %s has no file pipes/%s.yaml", pipeName, pipePath, pipeName))
+			continue
+		}
+
+		routes = append(routes, route{
+			bundleID: b.BundleID,
+			pipeName: pipeName,
+			path:     path.Clean("/" + b.BasePath + "/" + pipePath),
+		})
+	}
+
+	//the template requires every pipe file to be referenced
+	fileInfos, err := ioutil.ReadDir(path.Join(bundlePath, "pipes"))
+	if err != nil {
+		return routes, append(problems, problem(client.ErrorCodePipeMissing, "Unable to read pipes.  %s", err))
+	}
+
+	for _, fileInfo := range fileInfos {
+		pipeName := strings.TrimSuffix(fileInfo.Name(), ".yaml")
+
+		if !fileInfo.IsDir() && strings.HasSuffix(fileInfo.Name(), ".yaml") && !definedPipes[pipeName] {
+			problems = append(problems, problem(client.ErrorCodePipeMissing, "Pipe file pipes/%s is not referenced in bundle.yaml", fileInfo.Name()))
+		}
+	}
+
+	return routes, problems
+}
+
+//validateTarget the target must be an absolute http(s) url
+func validateTarget(target string) error {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	if targetURL.Scheme != "http" && targetURL.Scheme != "https" {
+		return fmt.Errorf("Scheme must be http or https")
+	}
+
+	if targetURL.Host == "" {
+		return fmt.Errorf("No host is specified")
+	}
+
+	return nil
+}
+
+//parseVirtualHost parse a virtual host in any of the forms nginx accepts for listen.  host:port, *:port or port
+func parseVirtualHost(virtualHost string) (listenAddress, error) {
+	host, portString, err := net.SplitHostPort(virtualHost)
+	if err != nil {
+		//just a port
+		host = ""
+		portString = virtualHost
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return listenAddress{}, fmt.Errorf("Port %s is not valid", portString)
+	}
+
+	if host == "*" || host == "0.0.0.0" || host == "::" {
+		host = ""
+	}
+
+	return listenAddress{host: strings.ToLower(host), port: port}, nil
+}
+
+//hostsOverlap true if any of the addresses would receive the same requests.  A bundle without virtual hosts is served on every listener
+func hostsOverlap(first, second []listenAddress) bool {
+	if len(first) == 0 || len(second) == 0 {
+		return true
+	}
+
+	for _, firstAddress := range first {
+		for _, secondAddress := range second {
+			if firstAddress.port != secondAddress.port {
+				continue
+			}
+
+			if firstAddress.host == "" || secondAddress.host == "" || firstAddress.host == secondAddress.host {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+package nginx_test
+
+import (
+	"os"
+	"path"
+
+	"github.com/30x/keymaster/client"
+	"github.com/30x/keymaster/nginx"
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidateDeployment", func() {
+
+	var stageDir string
+
+	BeforeEach(func() {
+		var err error
+		stageDir, err = util.MkTempDir("", "validate", 0755)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stageDir)
+	})
+
+	//stage copies the test bundle for each bundle in the deployment
+	stage := func(bundles ...*client.DeploymentBundle) *client.Deployment {
+		for _, b := range bundles {
+			err := copyDirRecursive("../test/template/testbundle", path.Join(stageDir, b.BundleID))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		return &client.Deployment{
+			ID:      "deployment_id",
+			Bundles: bundles,
+		}
+	}
+
+	It("should accept bundles on different paths", func() {
+		deployment := stage(
+			&client.DeploymentBundle{BundleID: "bundle1", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+			&client.DeploymentBundle{BundleID: "bundle2", BasePath: "basepath2", Target: "https://localhost:9443", VirtualHosts: []string{"localhost:8080"}},
+		)
+
+		Expect(nginx.ValidateDeployment(stageDir, deployment)).To(BeNil())
+	})
+
+	It("should accept the same path on different virtual hosts", func() {
+		deployment := stage(
+			&client.DeploymentBundle{BundleID: "bundle1", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+			&client.DeploymentBundle{BundleID: "bundle2", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8081", "example.com:8080"}},
+		)
+
+		Expect(nginx.ValidateDeployment(stageDir, deployment)).To(BeNil())
+	})
+
+	It("should report the same path on overlapping virtual hosts", func() {
+		deployment := stage(
+			&client.DeploymentBundle{BundleID: "bundle1", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"127.0.0.1:8080"}},
+			&client.DeploymentBundle{BundleID: "bundle2", BasePath: "/basepath/", Target: "http://localhost", VirtualHosts: []string{"*:8080"}},
+		)
+
+		deploymentErr := nginx.ValidateDeployment(stageDir, deployment)
+		Expect(deploymentErr).NotTo(BeNil())
+
+		//both pipes conflict, and each conflict is reported against both bundles
+		Expect(deploymentErr.BundleErrors).Should(HaveLen(4))
+
+		bundleIDs := []string{}
+		for _, bundleErr := range deploymentErr.BundleErrors {
+			bundleIDs = append(bundleIDs, bundleErr.BundleID)
+		}
+		Expect(bundleIDs).Should(ConsistOf("bundle1", "bundle2", "bundle1", "bundle2"))
+
+		Expect(deploymentErr.BundleErrors[0].Reason).Should(Equal("Path /basepath of pipe dump conflicts with pipe dump in bundle bundle2"))
+		Expect(deploymentErr.BundleErrors[0].ErrorCode).Should(Equal(client.ErrorCodeConflict))
+		Expect(deploymentErr.ErrorCode).Should(Equal(client.ErrorCodeConflict))
+	})
+
+	It("should report invalid targets and virtual hosts", func() {
+		deployment := stage(
+			&client.DeploymentBundle{BundleID: "bundle1", BasePath: "basepath", Target: "localhost", VirtualHosts: []string{"localhost:8080"}},
+			&client.DeploymentBundle{BundleID: "bundle2", BasePath: "basepath2", Target: "http://localhost", VirtualHosts: []string{"localhost:http", "localhost:8081", "localhost:8081"}},
+		)
+
+		deploymentErr := nginx.ValidateDeployment(stageDir, deployment)
+		Expect(deploymentErr).NotTo(BeNil())
+		Expect(deploymentErr.BundleErrors).Should(HaveLen(3))
+
+		Expect(deploymentErr.BundleErrors[0].BundleID).Should(Equal("bundle1"))
+		Expect(deploymentErr.BundleErrors[0].Reason).Should(ContainSubstring("Target localhost is invalid"))
+		Expect(deploymentErr.BundleErrors[0].ErrorCode).Should(Equal(client.ErrorCodeDeploymentInvalid))
+
+		Expect(deploymentErr.BundleErrors[1].BundleID).Should(Equal("bundle2"))
+		Expect(deploymentErr.BundleErrors[1].Reason).Should(ContainSubstring("Virtual host localhost:http is invalid"))
+
+		Expect(deploymentErr.BundleErrors[2].BundleID).Should(Equal("bundle2"))
+		Expect(deploymentErr.BundleErrors[2].Reason).Should(ContainSubstring("listed more than once"))
+	})
+
+	It("should report missing pipe files", func() {
+		deployment := stage(
+			&client.DeploymentBundle{BundleID: "bundle1", BasePath: "basepath", Target: "http://localhost", VirtualHosts: []string{"localhost:8080"}},
+		)
+
+		err := os.Remove(path.Join(stageDir, "bundle1", "pipes", "apikey.yaml"))
+		Expect(err).NotTo(HaveOccurred())
+
+		deploymentErr := nginx.ValidateDeployment(stageDir, deployment)
+		Expect(deploymentErr).NotTo(BeNil())
+		Expect(deploymentErr.BundleErrors).Should(HaveLen(1))
+		Expect(deploymentErr.BundleErrors[0].BundleID).Should(Equal("bundle1"))
+		Expect(deploymentErr.BundleErrors[0].Reason).Should(ContainSubstring("pipes/apikey.yaml"))
+		Expect(deploymentErr.BundleErrors[0].ErrorCode).Should(Equal(client.ErrorCodePipeMissing))
+	})
+})
@@ -0,0 +1,166 @@
+package nginx
+
+import (
+	"net"
+	"sort"
+	"strconv"
+)
+
+//defaultPort the port bundles are served on when none of them declare a virtual host
+const defaultPort = 80
+
+//loopbackHost the host name that always resolves to a loopback address
+const loopbackHost = "localhost"
+
+//virtualHost the bundles served on one virtual host, so the system template can render a server block for each
+type virtualHost struct {
+	//Name the virtual host as the first bundle declared it
+	Name string
+	//Listen the address for the listen directive.  Just the port, unless the virtual host is a literal IP or localhost
+	Listen string
+	//ServerName the host for the server_name directive.  Empty if the virtual host is an IP or every host on the port
+	ServerName string
+	//Port the port of the virtual host
+	Port int
+	//Bundles the bundles served on the virtual host, ordered by ID.  A bundle without virtual hosts is served on every one
+	Bundles []bundle
+	//Locations the pipes of every bundle on the virtual host, longest path first
+	Locations []location
+}
+
+//location a pipe of a bundle, at the path it's served on
+type location struct {
+	//Path the bundle's base path joined with the pipe's path
+	Path   string
+	Bundle bundle
+	Pipe   pipe
+}
+
+//groupVirtualHosts the virtual hosts the bundles declare, ordered by port then host.
+//Virtual hosts that aren't valid are left out, validation has already reported them.  If none are declared every bundle is served on the default port
+func groupVirtualHosts(bundles []bundle) []virtualHost {
+	hostsByAddress := make(map[listenAddress]*virtualHost)
+	everyHost := []bundle{}
+
+	for _, b := range bundles {
+		if len(b.VirtualHosts) == 0 {
+			everyHost = append(everyHost, b)
+			continue
+		}
+
+		added := make(map[listenAddress]bool)
+
+		for _, name := range b.VirtualHosts {
+			address, err := parseVirtualHost(name)
+			if err != nil || added[address] {
+				continue
+			}
+
+			added[address] = true
+
+			host, ok := hostsByAddress[address]
+			if !ok {
+				host = newVirtualHost(name, address)
+				hostsByAddress[address] = host
+			}
+
+			host.Bundles = append(host.Bundles, b)
+		}
+	}
+
+	if len(hostsByAddress) == 0 {
+		port := strconv.Itoa(defaultPort)
+		hostsByAddress[listenAddress{port: defaultPort}] = newVirtualHost(port, listenAddress{port: defaultPort})
+	}
+
+	hosts := make(virtualHostsByAddress, 0, len(hostsByAddress))
+
+	for _, host := range hostsByAddress {
+		host.Bundles = append(host.Bundles, everyHost...)
+		sort.Sort(bundlesByID(host.Bundles))
+
+		host.Locations = hostLocations(host.Bundles)
+
+		hosts = append(hosts, *host)
+	}
+
+	sort.Sort(hosts)
+
+	return hosts
+}
+
+//newVirtualHost a virtual host without any bundles yet.  nginx picks the server block by server_name among those listening on a port,
+//so a host name only goes in server_name.  An IP is listened on, so the server block only gets requests sent to that address.
+//localhost is listened on too, otherwise it would be served on every interface, and as the default server for the port
+func newVirtualHost(name string, address listenAddress) *virtualHost {
+	host := &virtualHost{
+		Name:   name,
+		Listen: strconv.Itoa(address.port),
+		Port:   address.port,
+	}
+
+	if net.ParseIP(address.host) != nil {
+		host.Listen = net.JoinHostPort(address.host, host.Listen)
+	} else {
+		host.ServerName = address.host
+	}
+
+	if address.host == loopbackHost {
+		host.Listen = net.JoinHostPort(address.host, host.Listen)
+	}
+
+	return host
+}
+
+//hostLocations the locations of the bundles, longest path first so the most specific location comes first
+func hostLocations(bundles []bundle) []location {
+	locations := locationsByPath{}
+
+	for _, b := range bundles {
+		for _, p := range b.OrderedPipes {
+			locations = append(locations, location{
+				Path:   joinPath(b.Basepath, p.Path),
+				Bundle: b,
+				Pipe:   p,
+			})
+		}
+	}
+
+	sort.Sort(locations)
+
+	return locations
+}
+
+type virtualHostsByAddress []virtualHost
+
+func (hosts virtualHostsByAddress) Len() int      { return len(hosts) }
+func (hosts virtualHostsByAddress) Swap(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] }
+func (hosts virtualHostsByAddress) Less(i, j int) bool {
+	if hosts[i].Port != hosts[j].Port {
+		return hosts[i].Port < hosts[j].Port
+	}
+
+	if hosts[i].ServerName != hosts[j].ServerName {
+		return hosts[i].ServerName < hosts[j].ServerName
+	}
+
+	return hosts[i].Listen < hosts[j].Listen
+}
+
+type locationsByPath []location
+
+func (locations locationsByPath) Len() int { return len(locations) }
+func (locations locationsByPath) Swap(i, j int) {
+	locations[i], locations[j] = locations[j], locations[i]
+}
+func (locations locationsByPath) Less(i, j int) bool {
+	if len(locations[i].Path) != len(locations[j].Path) {
+		return len(locations[i].Path) > len(locations[j].Path)
+	}
+
+	if locations[i].Path != locations[j].Path {
+		return locations[i].Path < locations[j].Path
+	}
+
+	return locations[i].Bundle.ID < locations[j].Bundle.ID
+}
@@ -4,15 +4,42 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-
-	"github.com/tnine/mockhttpserver"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const host = "localhost:9000"
 
-//MockApidServer the container type for our test server
+//MockApidServer the container type for our test server.  Emulates the long polling of apid's /deployments/current
 type MockApidServer struct {
-	server *mockhttpserver.MockServer
+	server *httptest.Server
+
+	mutex sync.Mutex
+	//the response to /deployments/current
+	current *mockResponse
+	//the version of the current response, used to generate etags
+	version int
+	//closed and replaced every time the current deployment changes, to wake up blocked requests
+	changed chan struct{}
+	//the maximum number of seconds we'll hold a blocking request open.  0 means whatever the client asks for
+	maxBlock int
+	//the responses to /deployments/{id}
+	results map[string]*mockResponse
+	//closed when the server is stopped, to release blocked requests
+	stopped chan struct{}
+	//stopOnce so stopping more than once is safe
+	stopOnce sync.Once
+}
+
+type mockResponse struct {
+	status int
+	etag   string
+	body   []byte
 }
 
 //GetBundlesResponse the response json to the get bundles
@@ -36,12 +63,23 @@ type SystemBundle struct {
 
 //CreateMockApidServer create a mock apid server
 func CreateMockApidServer() *MockApidServer {
-	return &MockApidServer{
-		server: &mockhttpserver.MockServer{},
+	mockServer := &MockApidServer{
+		changed: make(chan struct{}),
+		results: make(map[string]*mockResponse),
+		stopped: make(chan struct{}),
 	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deployments/current", mockServer.getCurrent)
+	mux.HandleFunc("/deployments/", mockServer.postResult)
+
+	mockServer.server = httptest.NewUnstartedServer(mux)
+
+	return mockServer
 }
 
-//CreateGetBundles Create a get bundle request that returns the specified http status and body.  Does not make use of the If-Non-Match or block headers.
+//CreateGetBundles Create a get bundle request that returns the specified http status and body.  Replaces any existing deployment, and wakes up clients blocked on the previous one.
+//Honors the If-None-Match and block headers.  A positive timeout caps the number of seconds a blocking request is held open
 func (mockServer *MockApidServer) CreateGetBundles(status int, deploymentID string, system SystemBundle, bundles []Bundle, timeout int) error {
 
 	response := GetBundlesResponse{
@@ -58,29 +96,129 @@ func (mockServer *MockApidServer) CreateGetBundles(status int, deploymentID stri
 
 	log.Printf("Resposne data is %s", string(data))
 
-	//set this up
-	mockServer.server.NewGet("/deployments/current").ToResponse(status, data).Add()
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+
+	mockServer.version++
+	mockServer.maxBlock = timeout
+	mockServer.current = &mockResponse{
+		status: status,
+		etag:   fmt.Sprintf("%s-%d", deploymentID, mockServer.version),
+		body:   data,
+	}
 
-	// if timeout > 0 {
-	// 	timeoutValue := fmt.Sprintf("%d", timeout)
-	// 	get = get.AddHeader("block", timeoutValue)
-	// }
+	//signal anyone waiting on the old deployment
+	close(mockServer.changed)
+	mockServer.changed = make(chan struct{})
 
 	return nil
 }
 
 //MockDeployment mock a response to the deployment
 func (mockServer *MockApidServer) MockDeployment(deploymentID string, status int, body []byte) {
-	url := fmt.Sprintf("/deployments/%s", deploymentID)
-	mockServer.server.NewPost(url, "application/json", nil).ToResponse(status, body).Add()
+	mockServer.mutex.Lock()
+	defer mockServer.mutex.Unlock()
+
+	mockServer.results[deploymentID] = &mockResponse{
+		status: status,
+		body:   body,
+	}
 }
 
 //Start start the mock server
 func (mockServer *MockApidServer) Start() {
-	mockServer.server.StartAsync(host)
+	listener, err := net.Listen("tcp", host)
+
+	if err != nil {
+		log.Printf("Unable to listen on %s.  Error is %s", host, err)
+		return
+	}
+
+	mockServer.server.Listener = listener
+	mockServer.server.Start()
 }
 
-//Stop start the mock server
+//Stop stop the mock server.  Safe to call more than once
 func (mockServer *MockApidServer) Stop() error {
-	return mockServer.server.Shutdown()
+	mockServer.stopOnce.Do(func() {
+		close(mockServer.stopped)
+		mockServer.server.Close()
+	})
+	return nil
+}
+
+//getCurrent serve the current deployment, blocking while the client already has it
+func (mockServer *MockApidServer) getCurrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	block, err := strconv.Atoi(r.Header.Get("block"))
+
+	if err != nil {
+		block = 0
+	}
+
+	mockServer.mutex.Lock()
+	if mockServer.maxBlock > 0 && block > mockServer.maxBlock {
+		block = mockServer.maxBlock
+	}
+	mockServer.mutex.Unlock()
+
+	deadline := time.After(time.Duration(block) * time.Second)
+
+	for {
+		mockServer.mutex.Lock()
+		current := mockServer.current
+		changed := mockServer.changed
+		mockServer.mutex.Unlock()
+
+		if current == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if current.etag != r.Header.Get("If-None-Match") {
+			if current.status == http.StatusOK {
+				w.Header().Set("ETag", current.etag)
+			}
+			w.WriteHeader(current.status)
+			w.Write(current.body)
+			return
+		}
+
+		//the client is up to date, wait for a change
+		select {
+		case <-changed:
+		case <-deadline:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-mockServer.stopped:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+}
+
+//postResult respond to a deployment result with the mocked response for that deployment
+func (mockServer *MockApidServer) postResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	deploymentID := strings.TrimPrefix(r.URL.Path, "/deployments/")
+
+	mockServer.mutex.Lock()
+	response, ok := mockServer.results[deploymentID]
+	mockServer.mutex.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(response.status)
+	w.Write(response.body)
 }
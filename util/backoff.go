@@ -0,0 +1,70 @@
+package util
+
+import (
+	"math"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+//Backoff exponential backoff with jitter.  Each call to Next waits longer than the last, up to Max, until Reset is called
+type Backoff struct {
+	//Initial the delay after the first failure
+	Initial time.Duration
+	//Max the longest delay
+	Max time.Duration
+	//Multiplier how much the delay grows after each failure
+	Multiplier float64
+	//Jitter the fraction of the delay that's randomized, so gateways that failed together don't retry together.  0 to 1
+	Jitter float64
+
+	mutex    sync.Mutex
+	attempts int
+	random   *mathrand.Rand
+}
+
+//NewBackoff create a backoff doubling from initial to max, with 20% jitter
+func NewBackoff(initial, max time.Duration) *Backoff {
+	return &Backoff{
+		Initial:    initial,
+		Max:        max,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+}
+
+//Next the delay before the next attempt.  Always 0 if Initial is
+func (backoff *Backoff) Next() time.Duration {
+	backoff.mutex.Lock()
+	defer backoff.mutex.Unlock()
+
+	//it never grows, and 0 * an overflowed Pow is NaN
+	if backoff.Initial <= 0 {
+		return 0
+	}
+
+	if backoff.random == nil {
+		backoff.random = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	}
+
+	delay := float64(backoff.Initial) * math.Pow(backoff.Multiplier, float64(backoff.attempts))
+
+	if math.IsNaN(delay) || delay > float64(backoff.Max) {
+		delay = float64(backoff.Max)
+	} else {
+		backoff.attempts++
+	}
+
+	//spread the delay evenly either side of the exponential value
+	delay += delay * backoff.Jitter * (2*backoff.random.Float64() - 1)
+
+	return time.Duration(delay)
+}
+
+//Reset start again from the initial delay, after a success
+func (backoff *Backoff) Reset() {
+	backoff.mutex.Lock()
+	defer backoff.mutex.Unlock()
+
+	backoff.attempts = 0
+}
@@ -0,0 +1,76 @@
+package util_test
+
+import (
+	"time"
+
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backoff", func() {
+
+	It("should grow exponentially up to the max", func() {
+		backoff := util.NewBackoff(time.Second, 10*time.Second)
+		backoff.Jitter = 0
+
+		delays := []time.Duration{}
+		for i := 0; i < 6; i++ {
+			delays = append(delays, backoff.Next())
+		}
+
+		Expect(delays).Should(Equal([]time.Duration{
+			time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second,
+		}))
+	})
+
+	It("should start again after a reset", func() {
+		backoff := util.NewBackoff(time.Second, 10*time.Second)
+		backoff.Jitter = 0
+
+		backoff.Next()
+		backoff.Next()
+		backoff.Reset()
+
+		Expect(backoff.Next()).Should(Equal(time.Second))
+	})
+
+	It("should never wait with no initial delay", func() {
+		backoff := util.NewBackoff(0, 10*time.Second)
+
+		//enough attempts for the exponent to overflow
+		for i := 0; i < 2000; i++ {
+			Expect(backoff.Next()).Should(Equal(time.Duration(0)))
+		}
+	})
+
+	It("should stay at the max once the delay overflows", func() {
+		backoff := util.NewBackoff(time.Second, 10*time.Second)
+		backoff.Multiplier = 1e300
+		backoff.Jitter = 0
+
+		for i := 0; i < 5; i++ {
+			backoff.Next()
+		}
+
+		Expect(backoff.Next()).Should(Equal(10 * time.Second))
+	})
+
+	It("should jitter within the configured fraction", func() {
+		backoff := util.NewBackoff(time.Second, time.Second)
+		backoff.Jitter = 0.5
+
+		seen := make(map[time.Duration]bool)
+
+		for i := 0; i < 50; i++ {
+			delay := backoff.Next()
+
+			Expect(delay).Should(BeNumerically(">=", 500*time.Millisecond))
+			Expect(delay).Should(BeNumerically("<=", 1500*time.Millisecond))
+
+			seen[delay] = true
+		}
+
+		Expect(len(seen)).Should(BeNumerically(">", 1))
+	})
+})
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+//WritableDir create dir if it doesn't exist and check we can write to it.  If we can't, e.g. it's under /var/lib and we aren't root, fallback is used instead
+func WritableDir(dir, fallback string) (string, error) {
+	err := checkWritable(dir)
+
+	if err == nil {
+		return dir, nil
+	}
+
+	log.Printf("Unable to write to %s, using %s instead.  Error is %s", dir, fallback, err)
+
+	err = checkWritable(fallback)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fallback, nil
+}
+
+//checkWritable create the dir and a file in it
+func checkWritable(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(dir, ".writable")
+
+	if err != nil {
+		return err
+	}
+
+	file.Close()
+
+	return os.Remove(file.Name())
+}
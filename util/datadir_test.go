@@ -0,0 +1,52 @@
+package util_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WritableDir", func() {
+
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "datadir")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should create the dir", func() {
+		dir := filepath.Join(tmpDir, "data")
+
+		Expect(util.WritableDir(dir, filepath.Join(tmpDir, "fallback"))).Should(Equal(dir))
+		Expect(dir).Should(BeADirectory())
+	})
+
+	It("should fall back when the dir can't be created", func() {
+		//a file where a parent dir should be fails even for root
+		blocker := filepath.Join(tmpDir, "blocker")
+		Expect(ioutil.WriteFile(blocker, []byte{}, 0644)).To(Succeed())
+
+		fallback := filepath.Join(tmpDir, "fallback")
+
+		Expect(util.WritableDir(filepath.Join(blocker, "data"), fallback)).Should(Equal(fallback))
+		Expect(fallback).Should(BeADirectory())
+	})
+
+	It("should fail when neither dir can be created", func() {
+		blocker := filepath.Join(tmpDir, "blocker")
+		Expect(ioutil.WriteFile(blocker, []byte{}, 0644)).To(Succeed())
+
+		_, err := util.WritableDir(filepath.Join(blocker, "data"), filepath.Join(blocker, "fallback"))
+		Expect(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+//Download stream the url to destFile.  If authCode is not empty it's sent as a bearer token.
+//The file is written to a temporary file next to destFile and renamed into place once complete, so a partial download is never left at destFile.
+//Cancelling ctx abandons the download
+func Download(ctx context.Context, client *http.Client, url, authCode, destFile string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+
+	if authCode != "" {
+		req.Header.Add("Authorization", "Bearer "+authCode)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer safeClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to download %s.  Status code is %d", url, resp.StatusCode)
+	}
+
+	destDir := filepath.Dir(destFile)
+	err = os.MkdirAll(destDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(destDir, filepath.Base(destFile)+".download")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmpFile, resp.Body)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Unable to download %s.  Error is %s", url, err)
+	}
+
+	return os.Rename(tmpFile.Name(), destFile)
+}
@@ -2,59 +2,283 @@ package util
 
 import (
 	"archive/zip"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
-	"log"
+	"strings"
 )
 
+//maxSymlinkSize the longest symlink target we'll read from an archive
+const maxSymlinkSize = 4096
+
+//UnzipLimits limits on the archives we're willing to extract, to protect the host from broken or malicious bundles.  A zero value for any limit disables it
+type UnzipLimits struct {
+	//MaxTotalSize the maximum number of bytes the archive may expand to
+	MaxTotalSize int64
+	//MaxFiles the maximum number of entries in the archive
+	MaxFiles int
+	//MaxCompressionRatio the maximum ratio of the uncompressed size to the compressed size of the archive
+	MaxCompressionRatio float64
+}
+
+//DefaultUnzipLimits the limits used by Unzip
+var DefaultUnzipLimits = UnzipLimits{
+	MaxTotalSize:        512 * 1024 * 1024,
+	MaxFiles:            10000,
+	MaxCompressionRatio: 100,
+}
+
+//Unzip extract the zip file into destDir using the DefaultUnzipLimits
 func Unzip(zipFile, destDir string) error {
+	return UnzipWithLimits(zipFile, destDir, DefaultUnzipLimits)
+}
+
+//UnzipWithLimits extract the zip file into destDir.  Returns an error without extracting anything if the archive exceeds the limits,
+//and fails if any entry or symlink would be written outside of destDir
+func UnzipWithLimits(zipFile, destDir string, limits UnzipLimits) error {
 	r, err := zip.OpenReader(zipFile)
 	if err != nil {
 		return err
 	}
 	defer safeClose(r)
 
+	err = checkLimits(zipFile, r.File, limits)
+	if err != nil {
+		return err
+	}
+
 	os.MkdirAll(destDir, 0755) // 7=rwx 5=r-x 5=r-x
 
+	destDir, err = filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+
+	//compare against where dest really is, since we check where entries resolve to
+	destDir, err = filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return err
+	}
+
+	//the sizes in the archive are only what it claims. Enforce the limit on what we actually write
+	remaining := limits.MaxTotalSize
+
 	for _, f := range r.File {
-		err := extractFileFromZip(f, destDir)
+		written, err := extractFileFromZip(f, destDir, remaining, limits.MaxTotalSize > 0)
 		if err != nil {
-			return err
+			return fmt.Errorf("Unable to extract %s from %s.  %s", f.Name, zipFile, err)
 		}
+
+		remaining -= written
+	}
+
+	//symlinks created later in the archive can change where earlier ones lead
+	err = checkSymlinks(destDir)
+	if err != nil {
+		return fmt.Errorf("Unable to extract %s.  %s", zipFile, err)
 	}
 
 	return nil
 }
 
-func extractFileFromZip(f *zip.File, dest string) error {
+//checkLimits validate the archive headers against the limits before we write anything
+func checkLimits(zipFile string, files []*zip.File, limits UnzipLimits) error {
+	if limits.MaxFiles > 0 && len(files) > limits.MaxFiles {
+		return fmt.Errorf("Archive %s contains %d files, the limit is %d", zipFile, len(files), limits.MaxFiles)
+	}
+
+	var compressed, uncompressed uint64
+
+	for _, f := range files {
+		compressed += f.CompressedSize64
+		uncompressed += f.UncompressedSize64
+	}
+
+	if limits.MaxTotalSize > 0 && uncompressed > uint64(limits.MaxTotalSize) {
+		return fmt.Errorf("Archive %s expands to %d bytes, the limit is %d", zipFile, uncompressed, limits.MaxTotalSize)
+	}
+
+	if limits.MaxCompressionRatio > 0 && compressed > 0 {
+		ratio := float64(uncompressed) / float64(compressed)
+
+		if ratio > limits.MaxCompressionRatio {
+			return fmt.Errorf("Archive %s has a compression ratio of %.0f, the limit is %.0f", zipFile, ratio, limits.MaxCompressionRatio)
+		}
+	}
+
+	return nil
+}
+
+//extractFileFromZip write the entry into dest, writing at most maxSize bytes if limited.  Returns the number of bytes written
+func extractFileFromZip(f *zip.File, dest string, maxSize int64, limited bool) (int64, error) {
+	if filepath.IsAbs(f.Name) || strings.HasPrefix(f.Name, "/") || strings.HasPrefix(f.Name, `\`) {
+		return 0, fmt.Errorf("Path is absolute")
+	}
+
+	path, err := containedPath(dest, f.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	//the entry's name is inside dest, make sure symlinks we've already extracted don't lead somewhere else
+	err = checkResolved(dest, path)
+	if err != nil {
+		return 0, err
+	}
+
 	rc, err := f.Open()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer safeClose(rc)
 
-	path := filepath.Join(dest, f.Name)
-
 	if f.FileInfo().IsDir() {
 		os.MkdirAll(path, f.Mode())
-	} else {
-		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		return 0, nil
+	}
+
+	os.MkdirAll(filepath.Dir(path), 0755)
+
+	if f.Mode()&os.ModeSymlink != 0 {
+		return 0, extractSymlink(rc, dest, path)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	if err != nil {
+		return 0, err
+	}
+	defer safeClose(file)
+
+	if !limited {
+		return io.Copy(file, rc)
+	}
+
+	//read one past the limit so we can tell if it was exceeded
+	written, err := io.Copy(file, io.LimitReader(rc, maxSize+1))
+	if err != nil {
+		return written, err
+	}
+
+	if written > maxSize {
+		return written, fmt.Errorf("Archive expands past the size limit")
+	}
+
+	return written, nil
+}
+
+//extractSymlink create the symlink at path, as long as its target is within dest
+func extractSymlink(rc io.Reader, dest, path string) error {
+	targetBytes, err := ioutil.ReadAll(io.LimitReader(rc, maxSymlinkSize))
+	if err != nil {
+		return err
+	}
+
+	target := string(targetBytes)
+
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("Symlink target %s is an absolute path", target)
+	}
+
+	//relative to where the link's directory really is, not the path through any symlinks
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = containedPath(dest, filepath.Join(parent, target))
+	if err != nil {
+		return fmt.Errorf("Symlink target %s is outside the destination directory", target)
+	}
+
+	return os.Symlink(target, path)
+}
+
+//containedPath join name onto dest, returning an error if the result is outside of dest
+func containedPath(dest, name string) (string, error) {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dest, name)
+	}
+
+	path := filepath.Clean(name)
+
+	if !isWithin(dest, path) {
+		return "", fmt.Errorf("Path is outside the destination directory")
+	}
+
+	return path, nil
+}
+
+//checkResolved make sure writing path won't leave dest by following a symlink.  Its nearest existing ancestor must resolve inside dest,
+//and path itself must not be a symlink we'd write through
+func checkResolved(dest, path string) error {
+	dir := filepath.Dir(path)
+
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+
+		dir = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	if !isWithin(dest, resolved) {
+		return fmt.Errorf("Path resolves outside the destination directory")
+	}
+
+	fileInfo, err := os.Lstat(path)
+	if err == nil && fileInfo.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("Path would be written through a symlink")
+	}
+
+	return nil
+}
+
+//checkSymlinks make sure every symlink under dest that leads anywhere leads somewhere inside dest
+func checkSymlinks(dest string) error {
+	return filepath.Walk(dest, func(filePath string, fileInfo os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		defer safeClose(f)
 
-		_, err = io.Copy(f, rc)
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		resolved, err := filepath.EvalSymlinks(filePath)
+
+		//dangling, it doesn't lead anywhere
 		if err != nil {
-			return err
+			return nil
 		}
-	}
-	return nil
+
+		if !isWithin(dest, resolved) {
+			return fmt.Errorf("Symlink %s resolves outside the destination directory", filePath)
+		}
+
+		return nil
+	})
+}
+
+//isWithin true if path is dest or inside it
+func isWithin(dest, path string) bool {
+	return path == dest || strings.HasPrefix(path, dest+string(os.PathSeparator))
 }
 
 func safeClose(f io.Closer) {
 	if err := f.Close(); err != nil {
 		log.Print(err)
 	}
-}
\ No newline at end of file
+}
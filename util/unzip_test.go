@@ -1,12 +1,15 @@
 package util_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path"
+	"io/ioutil"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/30x/keymaster/util"
-	"io/ioutil"
-	"path"
-	"os"
 )
 
 var _ = Describe("Unzip", func() {
@@ -22,7 +25,7 @@ var _ = Describe("Unzip", func() {
 		err = util.Unzip(zipfile, tmpDir)
 		Expect(err).NotTo(HaveOccurred())
 
-		bundleFile := path.Join(tmpDir, "bundle.conf")
+		bundleFile := path.Join(tmpDir, "bundle.yaml")
 		Expect(bundleFile).Should(BeAnExistingFile())
 
 		pipeFile := path.Join(tmpDir, "pipes/apikey.yaml")
@@ -31,4 +34,206 @@ var _ = Describe("Unzip", func() {
 		pipeFile = path.Join(tmpDir, "pipes/dump.yaml")
 		Expect(pipeFile).Should(BeAnExistingFile())
 	})
+
+	Describe("malicious archives", func() {
+
+		var tmpDir string
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "TestUnzip")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		It("should reject entries outside the destination", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{{name: "../evil.txt", body: "evil"}})
+
+			destDir := path.Join(tmpDir, "dest")
+
+			err := util.Unzip(zipfile, destDir)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("../evil.txt"))
+
+			Expect(path.Join(tmpDir, "evil.txt")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should reject absolute entries", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{{name: path.Join(tmpDir, "evil.txt"), body: "evil"}})
+
+			err := util.Unzip(zipfile, path.Join(tmpDir, "dest"))
+			Expect(err).To(HaveOccurred())
+
+			Expect(path.Join(tmpDir, "evil.txt")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should reject absolute entries inside the destination", func() {
+			destDir := path.Join(tmpDir, "dest")
+			Expect(os.Mkdir(destDir, 0755)).To(Succeed())
+
+			zipfile := writeZip(tmpDir, []zipEntry{{name: path.Join(destDir, "absolute.txt"), body: "absolute"}})
+
+			err := util.Unzip(zipfile, destDir)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("absolute"))
+
+			Expect(path.Join(destDir, "absolute.txt")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should reject chained symlinks that lead outside the destination", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{
+				{name: "s", body: ".", symlink: true},
+				{name: "s/t", body: ".", symlink: true},
+				{name: "s/t/u", body: ".", symlink: true},
+				{name: "s/t/u/link", body: "../../../outside", symlink: true},
+				{name: "link/pwned.txt", body: "owned"},
+			})
+
+			destDir := path.Join(tmpDir, "dest")
+
+			err := util.Unzip(zipfile, destDir)
+			Expect(err).To(HaveOccurred())
+
+			Expect(path.Join(tmpDir, "outside")).ShouldNot(BeAnExistingFile())
+			Expect(path.Join(tmpDir, "outside", "pwned.txt")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should reject writing through a symlink that leads outside the destination", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{
+				{name: "a", body: "b/..", symlink: true},
+				{name: "b", body: ".", symlink: true},
+				{name: "a/pwned.txt", body: "owned"},
+			})
+
+			err := util.Unzip(zipfile, path.Join(tmpDir, "dest"))
+			Expect(err).To(HaveOccurred())
+
+			Expect(path.Join(tmpDir, "pwned.txt")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should reject symlinks that only lead outside once the archive is extracted", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{
+				{name: "a", body: "b/..", symlink: true},
+				{name: "b", body: ".", symlink: true},
+			})
+
+			err := util.Unzip(zipfile, path.Join(tmpDir, "dest"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("outside the destination"))
+		})
+
+		It("should reject files written through symlinks", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{
+				{name: "pipes/dump.yaml", body: "request:"},
+				{name: "dump.yaml", body: "pipes/dump.yaml", symlink: true},
+				{name: "dump.yaml", body: "overwritten"},
+			})
+
+			err := util.Unzip(zipfile, path.Join(tmpDir, "dest"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("through a symlink"))
+		})
+
+		It("should reject symlinks outside the destination", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{{name: "link", body: "../../etc", symlink: true}})
+
+			err := util.Unzip(zipfile, path.Join(tmpDir, "dest"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("outside the destination"))
+		})
+
+		It("should allow symlinks inside the destination", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{
+				{name: "pipes/dump.yaml", body: "request:"},
+				{name: "dump.yaml", body: "pipes/dump.yaml", symlink: true},
+			})
+
+			destDir := path.Join(tmpDir, "dest")
+
+			err := util.Unzip(zipfile, destDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			content, err := ioutil.ReadFile(path.Join(destDir, "dump.yaml"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).Should(Equal("request:"))
+		})
+
+		It("should reject too many files", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{{name: "1", body: "1"}, {name: "2", body: "2"}, {name: "3", body: "3"}})
+
+			err := util.UnzipWithLimits(zipfile, path.Join(tmpDir, "dest"), util.UnzipLimits{MaxFiles: 2})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("contains 3 files"))
+		})
+
+		It("should reject archives that are too large", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{{name: "big", body: randomString(2048)}})
+
+			err := util.UnzipWithLimits(zipfile, path.Join(tmpDir, "dest"), util.UnzipLimits{MaxTotalSize: 1024})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("expands to 2048 bytes"))
+
+			Expect(path.Join(tmpDir, "dest", "big")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("should reject highly compressed archives", func() {
+			zipfile := writeZip(tmpDir, []zipEntry{{name: "zeros", body: string(make([]byte, 1024*1024))}})
+
+			err := util.UnzipWithLimits(zipfile, path.Join(tmpDir, "dest"), util.UnzipLimits{MaxCompressionRatio: 100})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("compression ratio"))
+		})
+	})
 })
+
+type zipEntry struct {
+	name    string
+	body    string
+	symlink bool
+}
+
+//writeZip create a zip in dir with the entries, without any of the sanitizing a zip tool would do
+func writeZip(dir string, entries []zipEntry) string {
+	buffer := &bytes.Buffer{}
+	writer := zip.NewWriter(buffer)
+
+	for _, entry := range entries {
+		header := &zip.FileHeader{
+			Name:   entry.name,
+			Method: zip.Deflate,
+		}
+
+		if entry.symlink {
+			header.SetMode(os.ModeSymlink | 0777)
+		} else {
+			header.SetMode(0644)
+		}
+
+		w, err := writer.CreateHeader(header)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = w.Write([]byte(entry.body))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	Expect(writer.Close()).To(Succeed())
+
+	zipfile := path.Join(dir, "test.zip")
+	Expect(ioutil.WriteFile(zipfile, buffer.Bytes(), 0644)).To(Succeed())
+
+	return zipfile
+}
+
+//randomString a string that won't compress well
+func randomString(length int) string {
+	b := make([]byte, length)
+	seed := uint32(1)
+	for i := range b {
+		seed = seed*1664525 + 1013904223
+		b[i] = byte('a' + (seed>>24)%26)
+	}
+	return string(b)
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+)
+
+//HashFile the sha256 of the file contents
+func HashFile(fileName string) ([]byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(file)
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+//LoadPublicKeys load every PEM encoded public key in the file
+func LoadPublicKeys(fileName string) ([]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePublicKeys(data)
+}
+
+//ParsePublicKeys parse every PEM encoded PKIX public key in data.  Only RSA and ECDSA keys are supported.
+//Any other PEM block is an error, as is data without any keys, so a misconfigured keys file can't silently trust nothing
+func ParsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	keys := []crypto.PublicKey{}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+
+		if block == nil {
+			break
+		}
+
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("Unsupported PEM block %s, expected PUBLIC KEY", block.Type)
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("Unsupported public key type %T", key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("No PEM encoded public keys found")
+	}
+
+	return keys, nil
+}
+
+//VerifyFile check the file against the hex encoded sha256 checksum and the base64 encoded signature of its sha256 digest.
+//Either may be empty, in which case it isn't checked.  The signature must be from one of the trusted keys
+func VerifyFile(fileName, checksum, signature string, trustedKeys []crypto.PublicKey) error {
+	if checksum == "" && signature == "" {
+		return nil
+	}
+
+	digest, err := HashFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	if checksum != "" && !strings.EqualFold(hex.EncodeToString(digest), checksum) {
+		return fmt.Errorf("Checksum mismatch.  Expected %s but was %s", checksum, hex.EncodeToString(digest))
+	}
+
+	if signature == "" {
+		return nil
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Signature is not valid base64.  %s", err)
+	}
+
+	if len(trustedKeys) == 0 {
+		return errors.New("Signature can't be verified, no trusted keys are configured")
+	}
+
+	for _, key := range trustedKeys {
+		if verifySignature(key, digest, signatureBytes) {
+			return nil
+		}
+	}
+
+	return errors.New("Signature does not match any trusted key")
+}
+
+//ecdsaSignature the ASN.1 structure of an ecdsa signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func verifySignature(key crypto.PublicKey, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		sig := &ecdsaSignature{}
+		_, err := asn1.Unmarshal(signature, sig)
+		if err != nil || sig.R == nil || sig.S == nil {
+			return false
+		}
+		return ecdsa.Verify(key, digest, sig.R, sig.S)
+	}
+
+	return false
+}
@@ -0,0 +1,127 @@
+package util_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+
+	"github.com/30x/keymaster/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VerifyFile", func() {
+
+	zipfile := "../test/testbundle.zip"
+
+	var digest []byte
+	var rsaKey *rsa.PrivateKey
+	var ecdsaKey *ecdsa.PrivateKey
+
+	BeforeEach(func() {
+		var err error
+
+		digest, err = util.HashFile(zipfile)
+		Expect(err).NotTo(HaveOccurred())
+
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+
+		ecdsaKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should accept a matching checksum", func() {
+		err := util.VerifyFile(zipfile, hex.EncodeToString(digest), "", nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject a mismatched checksum", func() {
+		err := util.VerifyFile(zipfile, "deadbeef", "", nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("Checksum mismatch"))
+	})
+
+	It("should accept an rsa signature from a trusted key", func() {
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+		Expect(err).NotTo(HaveOccurred())
+
+		keys := []crypto.PublicKey{ecdsaKey.Public(), rsaKey.Public()}
+
+		err = util.VerifyFile(zipfile, "", base64.StdEncoding.EncodeToString(signature), keys)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should accept an ecdsa signature from a trusted key", func() {
+		signature, err := ecdsaKey.Sign(rand.Reader, digest, crypto.SHA256)
+		Expect(err).NotTo(HaveOccurred())
+
+		keys := []crypto.PublicKey{rsaKey.Public(), ecdsaKey.Public()}
+
+		err = util.VerifyFile(zipfile, hex.EncodeToString(digest), base64.StdEncoding.EncodeToString(signature), keys)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject a signature from an untrusted key", func() {
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+		Expect(err).NotTo(HaveOccurred())
+
+		keys := []crypto.PublicKey{ecdsaKey.Public()}
+
+		err = util.VerifyFile(zipfile, "", base64.StdEncoding.EncodeToString(signature), keys)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).Should(ContainSubstring("does not match any trusted key"))
+	})
+
+	It("should reject a signature when there are no trusted keys", func() {
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = util.VerifyFile(zipfile, "", base64.StdEncoding.EncodeToString(signature), nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should parse PEM encoded public keys", func() {
+		pemData := []byte{}
+
+		for _, key := range []crypto.PublicKey{rsaKey.Public(), ecdsaKey.Public()} {
+			der, err := x509.MarshalPKIXPublicKey(key)
+			Expect(err).NotTo(HaveOccurred())
+
+			pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+		}
+
+		keys, err := util.ParsePublicKeys(pemData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).Should(HaveLen(2))
+	})
+
+	It("should reject data without any public keys", func() {
+		_, err := util.ParsePublicKeys([]byte("not a key"))
+		Expect(err).To(HaveOccurred())
+
+		_, err = util.ParsePublicKeys([]byte{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject PEM blocks that aren't PKIX public keys", func() {
+		der, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+		Expect(err).NotTo(HaveOccurred())
+
+		pemData := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+		for _, blockType := range []string{"RSA PUBLIC KEY", "CERTIFICATE"} {
+			other := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+
+			_, err := util.ParsePublicKeys(append(pemData, other...))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(blockType))
+		}
+	})
+})